@@ -2,13 +2,12 @@ package agent
 
 import (
 	"fmt"
-	kafka "github.com/Shopify/sarama"
 	"github.com/aiyi/agent/util"
-	"log"
 	"net"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type AgentD struct {
@@ -17,7 +16,7 @@ type AgentD struct {
 
 	sync.RWMutex
 
-	opts     *AgentdOptions
+	opts     atomic.Value
 	protocol Protocol
 
 	tcpAddr     *net.TCPAddr
@@ -25,119 +24,303 @@ type AgentD struct {
 
 	Clients map[string]*Conn
 
-	kafkaClient   *kafka.Client
-	KafkaProducer *kafka.Producer
+	sinkMtx sync.RWMutex
+	sink    EventSink
+
+	// capture files of the connections, when recording them
+	captures captureFiles
 
 	notifyChan chan interface{}
 	exitChan   chan int
 	waitGroup  util.WaitGroupWrapper
 
-	logger *log.Logger
+	// set once Exit starts
+	stopFlag int32
+	// covers every accepted connection until its clean close completes
+	clientsWaitGroup sync.WaitGroup
+
+	logger *Logger
+}
+
+// NewAgentD creates an agentd serving proto that publishes events to
+// the sinks selected by opts
+func NewAgentD(opts *AgentdOptions, proto Protocol) (*AgentD, error) {
+	sink, err := NewEventSink(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event sink - %s", err)
+	}
+	return NewAgentDWithSink(opts, proto, sink)
 }
 
-func NewAgentD(opts *AgentdOptions, proto Protocol) *AgentD {
+// NewAgentDWithSink creates an agentd that publishes events to sink,
+// which it closes on Exit. A reload that changes the sink options
+// replaces sink with the sinks they select.
+func NewAgentDWithSink(opts *AgentdOptions, proto Protocol, sink EventSink) (*AgentD, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", opts.TcpAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve TCP address %s - %s", opts.TcpAddress, err)
+	}
+
 	a := &AgentD{
-		opts:       opts,
 		protocol:   proto,
+		tcpAddr:    tcpAddr,
 		Clients:    make(map[string]*Conn),
+		sink:       sink,
 		exitChan:   make(chan int),
 		notifyChan: make(chan interface{}),
-		logger:     log.New(os.Stderr, "[agentd] ", log.Ldate|log.Ltime|log.Lmicroseconds),
+		logger:     DefaultLogger(),
 	}
+	a.opts.Store(opts)
+	SetLogOptions(opts)
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", opts.TcpAddress)
-	if err != nil {
-		a.logf("FATAL: failed to resolve TCP address (%s) - %s", opts.TcpAddress, err)
-		os.Exit(1)
+	return a, nil
+}
+
+func (a *AgentD) Options() *AgentdOptions {
+	return a.opts.Load().(*AgentdOptions)
+}
+
+// Reload applies opts to the running agentd without dropping any
+// connection. Startup options (see startupOptions) keep their current
+// values; the names of those that differ in opts are returned so that
+// the caller can report them as needing a restart.
+func (a *AgentD) Reload(opts *AgentdOptions) ([]string, error) {
+	old := a.Options()
+	restart := keepStartupOptions(old, opts)
+
+	if sinkOptionsChanged(old, opts) {
+		err := a.reloadSink(opts)
+		if err != nil {
+			return restart, fmt.Errorf("failed to reload event sink - %s", err)
+		}
 	}
-	a.tcpAddr = tcpAddr
 
-	kafkaClient, err := kafka.NewClient("agentd", []string{"localhost:9092"}, kafka.NewClientConfig())
-	if err != nil {
-		a.logf("FATAL: failed to create kafka client - %s", err)
-		os.Exit(1)
+	a.opts.Store(opts)
+
+	// the log level can also be changed at runtime, which only a
+	// change to the configured level overrides
+	if old.LogLevel != opts.LogLevel {
+		lvl, _ := ParseLogLevel(opts.LogLevel)
+		DefaultLogger().SetLevel(lvl)
+	}
+	if old.LogFormat != opts.LogFormat {
+		format, _ := ParseLogFormat(opts.LogFormat)
+		DefaultLogger().SetFormat(format)
 	}
+	return restart, nil
+}
+
+// reloadSink replaces the event sinks. The outbox of a sink that is
+// kept is kept too, so events queued for the old sink are delivered to
+// the new one.
+func (a *AgentD) reloadSink(opts *AgentdOptions) error {
+	a.sinkMtx.Lock()
+	defer a.sinkMtx.Unlock()
 
-	kafkaProducer, err := kafka.NewProducer(kafkaClient, nil)
+	sink, err := reloadEventSink(opts, a.sink)
 	if err != nil {
-		a.logf("FATAL: failed to create kafka producer - %s", err)
-		kafkaClient.Close()
-		os.Exit(1)
+		return err
 	}
+	a.sink = sink
+	return nil
+}
+
+// Publish hands an event to the event sinks
+func (a *AgentD) Publish(topic string, body []byte) error {
+	a.sinkMtx.RLock()
+	defer a.sinkMtx.RUnlock()
+	return a.sink.Publish(topic, body)
+}
 
-	a.kafkaClient = kafkaClient
-	a.KafkaProducer = kafkaProducer
+// ResetHeartbeats restarts the heartbeat timer of every client, to be
+// called after the protocol's heartbeat interval changes
+func (a *AgentD) ResetHeartbeats() {
+	a.RLock()
+	defer a.RUnlock()
 
-	return a
+	for _, c := range a.Clients {
+		c.ResetHeartbeat()
+	}
 }
 
 func (a *AgentD) GetServerIP() string {
 	return strings.Split(a.tcpAddr.String(), ":")[0]
 }
 
-func (a *AgentD) AddClient(clientID string, client *Conn) {
+// AddClient registers client under its current ID
+func (a *AgentD) AddClient(client *Conn) {
 	a.Lock()
 	defer a.Unlock()
 
-	_, ok := a.Clients[clientID]
+	_, ok := a.Clients[client.ID()]
 	if ok {
 		return
 	}
-	a.Clients[clientID] = client
+	a.Clients[client.ID()] = client
 }
 
-func (a *AgentD) RemoveClient(clientID string) {
+// RemoveClient unregisters client. An entry for the same ID belonging
+// to another connection is left alone.
+func (a *AgentD) RemoveClient(client *Conn) {
 	a.Lock()
 	defer a.Unlock()
 
-	_, ok := a.Clients[clientID]
-	if !ok {
+	if a.Clients[client.ID()] != client {
 		return
 	}
-	delete(a.Clients, clientID)
+	delete(a.Clients, client.ID())
 }
 
+// SetClientID re-registers client under the device ID id. It fails if
+// another connected client already has that ID, or with
+// ErrNotConnected once client has been removed.
+func (a *AgentD) SetClientID(client *Conn, id string) error {
+	a.Lock()
+	oldID := client.ID()
+	if a.Clients[oldID] != client {
+		a.Unlock()
+		return ErrNotConnected
+	}
+	if oldID == id {
+		a.Unlock()
+		return nil
+	}
+	other, ok := a.Clients[id]
+	if ok {
+		a.Unlock()
+		return fmt.Errorf("device ID %s in use by %s", id, other.remoteAddr)
+	}
+
+	delete(a.Clients, oldID)
+	client.id.Store(id)
+	a.Clients[id] = client
+	a.Unlock()
+
+	client.publishLifecycle(LifecycleIdentified, oldID, "")
+	if o, ok := a.protocol.(ClientObserver); ok {
+		o.ClientIdentified(client, oldID)
+	}
+	return nil
+}
+
+// GetClient looks a client up by device ID, falling back to its
+// <addr>:<port> or its IP address. An IP address shared by several
+// clients, such as that of a NAT gateway, matches none of them.
 func (a *AgentD) GetClient(clientID string) (*Conn, bool) {
 	a.RLock()
 	defer a.RUnlock()
 
 	c, ok := a.Clients[clientID]
-	if !ok {
-		return nil, false
+	if ok {
+		return c, true
+	}
+
+	var found *Conn
+	for _, c := range a.Clients {
+		if c.remoteAddr == clientID {
+			return c, true
+		}
+		if c.ip == clientID {
+			if found != nil {
+				return nil, false
+			}
+			found = c
+		}
 	}
-	return c, true
+	return found, found != nil
 }
 
-func (a *AgentD) Main() {
+// Main starts accepting clients
+func (a *AgentD) Main() error {
 	tcpListener, err := net.Listen("tcp", a.tcpAddr.String())
 	if err != nil {
-		a.logf("FATAL: listen (%s) failed - %s", a.tcpAddr, err)
-		os.Exit(1)
+		return fmt.Errorf("failed to listen on %s - %s", a.tcpAddr, err)
 	}
 	a.tcpListener = tcpListener
 
 	a.waitGroup.Wrap(func() {
 		tcpServer(a)
 	})
+	return nil
 }
 
-func (a *AgentD) Exit() {
+// TCPAddr returns the address clients connect to, which differs from
+// AgentdOptions.TcpAddress if that asks for an ephemeral port
+func (a *AgentD) TCPAddr() net.Addr {
 	if a.tcpListener != nil {
-		a.tcpListener.Close()
+		return a.tcpListener.Addr()
 	}
+	return a.tcpAddr
+}
 
-	a.KafkaProducer.Close()
-	a.kafkaClient.Close()
+// isStopping reports whether Exit has started
+func (a *AgentD) isStopping() bool {
+	return atomic.LoadInt32(&a.stopFlag) == 1
+}
 
-	// we want to do this last as it closes the idPump (if closed first it
-	// could potentially starve items in process and deadlock)
+// Exit shuts agentd down gracefully. It stops accepting clients and
+// closes every connection, each once the message it is handling has
+// been handled; commands still pending fail with ErrStopped. It then
+// waits for the events received so far to be delivered, by the
+// protocol (see Drainer) and to the event sinks, before closing the
+// sinks. Waiting ends after AgentdOptions.ShutdownTimeout; events
+// still queued then are delivered on the next start.
+func (a *AgentD) Exit() {
+	if !atomic.CompareAndSwapInt32(&a.stopFlag, 0, 1) {
+		return
+	}
+	deadline := time.Now().Add(a.Options().ShutdownTimeout)
+	a.logger.Info("shutting down", "timeout", a.Options().ShutdownTimeout)
+
+	if a.tcpListener != nil {
+		a.tcpListener.Close()
+	}
 	close(a.exitChan)
 	a.waitGroup.Wait()
+
+	a.closeClients(deadline)
+
+	if d, ok := a.protocol.(Drainer); ok {
+		err := d.Drain(deadline)
+		if err != nil {
+			a.logger.Warn("shutdown timeout expired", "err", err)
+		}
+	}
+
+	a.sinkMtx.Lock()
+	if f, ok := a.sink.(sinkFlusher); ok {
+		n := f.Flush(deadline)
+		if n > 0 {
+			a.logger.Warn("shutdown timeout expired", "err", fmt.Sprintf("%d events not delivered to the event sink", n))
+		}
+	}
+	a.sink.Close()
+	a.sinkMtx.Unlock()
 }
 
-func (a *AgentD) logf(f string, args ...interface{}) {
-	if a.logger == nil {
-		return
+// closeClients closes every connection and waits until deadline for
+// them to finish closing. Connections accepted but not started yet
+// close themselves in Start.
+func (a *AgentD) closeClients(deadline time.Time) {
+	a.RLock()
+	clients := make([]*Conn, 0, len(a.Clients))
+	for _, c := range a.Clients {
+		clients = append(clients, c)
+	}
+	a.RUnlock()
+
+	for _, c := range clients {
+		c.stop()
+	}
+
+	doneChan := make(chan int)
+	go func() {
+		a.clientsWaitGroup.Wait()
+		close(doneChan)
+	}()
+	select {
+	case <-doneChan:
+	case <-time.After(deadline.Sub(time.Now())):
+		a.logger.Warn("shutdown timeout expired", "err", "clients still closing")
 	}
-	a.logger.Output(2, fmt.Sprintf(f, args...))
 }
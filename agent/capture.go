@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture record directions
+const (
+	CaptureIn  = "in"
+	CaptureOut = "out"
+)
+
+// CaptureRecord is the raw bytes of a frame received from or sent to a
+// client, as they were on the wire
+type CaptureRecord struct {
+	Time time.Time
+	Dir  string
+	Data []byte
+}
+
+// CaptureWriter writes capture records as lines of the form
+//
+//	<RFC 3339 time> <in|out> <hex data>
+//
+// to a file that is rotated once it grows past maxBytes, keeping
+// maxFiles rotated files named <path>.1 (the newest) to <path>.<maxFiles>
+type CaptureWriter struct {
+	sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// NewCaptureWriter opens the capture file at path for appending. A
+// maxBytes of zero disables rotation.
+func NewCaptureWriter(path string, maxBytes int64, maxFiles int) (*CaptureWriter, error) {
+	w := &CaptureWriter{
+		path:     path,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+	}
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *CaptureWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	return nil
+}
+
+// rotate shifts <path>.n to <path>.n+1, dropping the oldest, and starts
+// a new file at path
+func (w *CaptureWriter) rotate() error {
+	w.f.Close()
+	w.f = nil
+
+	if w.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+		for n := w.maxFiles - 1; n > 0; n-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, n), fmt.Sprintf("%s.%d", w.path, n+1))
+		}
+		os.Rename(w.path, w.path+".1")
+	} else {
+		os.Remove(w.path)
+	}
+	return w.open()
+}
+
+// Write appends a record
+func (w *CaptureWriter) Write(rec CaptureRecord) error {
+	line := fmt.Sprintf("%s %s %s\n", rec.Time.UTC().Format(time.RFC3339Nano), rec.Dir, hex.EncodeToString(rec.Data))
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	if w.maxBytes > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxBytes {
+		err := w.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := io.WriteString(w.f, line)
+	w.size += int64(n)
+	return err
+}
+
+func (w *CaptureWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// ReadCapture calls fn with each record of the capture read from r in
+// order, stopping at the first error fn returns
+func ReadCapture(r io.Reader, fn func(rec CaptureRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid capture record on line %d", line)
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid time on line %d - %s", line, err)
+		}
+		if fields[1] != CaptureIn && fields[1] != CaptureOut {
+			return fmt.Errorf("invalid direction %q on line %d", fields[1], line)
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return fmt.Errorf("invalid data on line %d - %s", line, err)
+		}
+
+		err = fn(CaptureRecord{Time: t, Dir: fields[1], Data: data})
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// captureFileName names the capture file of a connection after the
+// host it comes from, so that every connection of an RSU is recorded in
+// the same rotated files however often it reconnects
+func captureFileName(dir string, remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	name := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(host)
+	return filepath.Join(dir, name+".cap")
+}
+
+// captureFiles shares the CaptureWriter of each capture file between
+// the connections writing to it, which would otherwise rotate the file
+// from under each other
+type captureFiles struct {
+	sync.Mutex
+	writers map[string]*CaptureWriter
+	refs    map[*CaptureWriter]int
+}
+
+// open returns the writer of the capture file at path, opening it with
+// maxBytes and maxFiles unless another connection has it open already
+func (f *captureFiles) open(path string, maxBytes int64, maxFiles int) (*CaptureWriter, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	w, ok := f.writers[path]
+	if !ok {
+		var err error
+		w, err = NewCaptureWriter(path, maxBytes, maxFiles)
+		if err != nil {
+			return nil, err
+		}
+		if f.writers == nil {
+			f.writers = make(map[string]*CaptureWriter)
+			f.refs = make(map[*CaptureWriter]int)
+		}
+		f.writers[path] = w
+	}
+	f.refs[w]++
+	return w, nil
+}
+
+// close releases a writer returned by open, closing it once the last
+// connection writing to it is done
+func (f *captureFiles) close(w *CaptureWriter) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.refs[w]--
+	if f.refs[w] > 0 {
+		return
+	}
+	delete(f.refs, w)
+	delete(f.writers, w.path)
+	w.Close()
+}
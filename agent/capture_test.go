@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The connections of a host share its capture file, so that however
+// often it reconnects at most maxFiles rotated files are kept
+func TestCaptureReconnects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var files captureFiles
+	rec := CaptureRecord{Time: time.Now(), Dir: CaptureIn, Data: make([]byte, 100)}
+	for port := 40000; port < 40020; port++ {
+		addr := fmt.Sprintf("10.0.0.1:%d", port)
+		w, err := files.open(captureFileName(dir, addr), 500, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// an overlapping connection from the same host
+		w2, err := files.open(captureFileName(dir, "10.0.0.1:50000"), 500, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w2 != w {
+			t.Fatal("connections of a host write to different capture files")
+		}
+		for i := 0; i < 3; i++ {
+			err := w.Write(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		files.close(w2)
+		files.close(w)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Fatalf("capture files %v, want 10.0.0.1.cap and 2 rotated", names)
+	}
+	if len(files.writers) != 0 || len(files.refs) != 0 {
+		t.Fatalf("%d capture files left open", len(files.writers))
+	}
+}
@@ -2,62 +2,26 @@ package agent
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"net"
-	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// LogLevel specifies the severity of a given log message
-type LogLevel int
-
-type logger interface {
-	Output(calldepth int, s string) error
-}
-
-// logging constants
-const (
-	LogLevelDebug LogLevel = iota
-	LogLevelInfo
-	LogLevelWarning
-	LogLevelError
-
-	LogLevelDebugPrefix   = "DBG"
-	LogLevelInfoPrefix    = "INF"
-	LogLevelWarningPrefix = "WRN"
-	LogLevelErrorPrefix   = "ERR"
-)
-
-// LogPrefix Resolution
-func logPrefix(lvl LogLevel) string {
-	var prefix string
-
-	switch lvl {
-	case LogLevelDebug:
-		prefix = LogLevelDebugPrefix
-	case LogLevelInfo:
-		prefix = LogLevelInfoPrefix
-	case LogLevelWarning:
-		prefix = LogLevelWarningPrefix
-	case LogLevelError:
-		prefix = LogLevelErrorPrefix
-	}
-
-	return prefix
-}
-
 // cmdTransaction is returned by the async send methods
 // to retrieve metadata about the command after the
 // response is received.
 type cmdTransaction struct {
-	req      Message
-	doneChan chan *cmdTransaction
-	resp     Message
+	id        uint32
+	req       Message
+	doneChan  chan *cmdTransaction
+	resp      Message
+	err       error
+	abandoned bool
 }
 
 func (t *cmdTransaction) finish() {
@@ -66,85 +30,230 @@ func (t *cmdTransaction) finish() {
 	}
 }
 
+// ConnStats is a snapshot of the activity on a Conn
+type ConnStats struct {
+	ConnectTime   time.Time
+	LastFrameTime time.Time
+	// round trip time of the last answered heartbeat
+	HeartbeatRTT time.Duration
+	// round trip times of all answered heartbeats
+	HeartbeatRTTHistogram []HistogramBucket
+	HeartbeatRTTSum       time.Duration
+
+	HeartbeatsSent     uint64
+	HeartbeatsAnswered uint64
+	HeartbeatsMissed   uint64
+	// heartbeats missed since the last one answered
+	ConsecutiveMisses uint32
+
+	MessagesIn          uint64
+	MessagesOut         uint64
+	WriteErrors         uint64
+	CommandTimeouts     uint64
+	UnexpectedResponses uint64
+	InFlight            int
+}
+
+// connStats holds the counters behind ConnStats; times are in
+// nanoseconds since the epoch
+type connStats struct {
+	connectTime         int64
+	lastFrameTime       int64
+	heartbeatRTT        int64
+	heartbeatSent       int64
+	heartbeatsSent      uint64
+	heartbeatsAnswered  uint64
+	heartbeatsMissed    uint64
+	messagesIn          uint64
+	messagesOut         uint64
+	writeErrors         uint64
+	commandTimeouts     uint64
+	unexpectedResponses uint64
+	heartbeatRTTs       rttHistogram
+	heartbeatID         uint32
+	consecutiveMisses   uint32
+}
+
 // Conn represents a client connection
 type Conn struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	stats connStats
+
 	agentd *AgentD
 
-	addr string
-	conn *net.TCPConn
+	// id is the device ID once the protocol has identified the peer
+	// and the remote address until then; only changed under agentd's
+	// lock so that it always matches the client's key
+	id         atomic.Value
+	ip         string
+	remoteAddr string
+	conn       *net.TCPConn
 
 	proto ProtoInstance
 
-	logger logger
-	logLvl LogLevel
-	logFmt string
-
 	r io.Reader
 	w io.Writer
 
+	// capture records the raw frames when AgentdOptions.CapturePath is
+	// set; captureIn is only touched by readLoop and captureOut by
+	// writeLoop
+	capture    *CaptureWriter
+	captureIn  []byte
+	captureOut []byte
+
 	transactionChan chan *cmdTransaction
 	msgResponseChan chan Message
+	heartbeatChan   chan int
 	exitChan        chan int
 	drainReady      chan int
 
-	transactions      []*cmdTransaction
+	transactionsMtx   sync.Mutex
+	transactions      map[uint32]*cmdTransaction
 	concurrentSenders int32
 
-	closeFlag int32
-	stopper   sync.Once
-	wg        sync.WaitGroup
+	closeFlag      int32
+	closeReasonMtx sync.Mutex
+	closeReason    string
+	stopper        sync.Once
+	wg             sync.WaitGroup
+
+	// last error from the underlying connection, only touched by readLoop
+	readErr error
 
 	readLoopRunning int32
 }
 
 // NewConn returns a new Conn instance
 func NewConn(a *AgentD, conn net.Conn) *Conn {
-	return &Conn{
-		agentd: a,
-		addr:   strings.Split(conn.RemoteAddr().String(), ":")[0],
-		conn:   conn.(*net.TCPConn),
-		r:      bufio.NewReader(conn),
-		w:      bufio.NewWriter(conn),
+	remoteAddr := conn.RemoteAddr().String()
+	ip, _, _ := net.SplitHostPort(remoteAddr)
 
-		proto: a.protocol.NewProtoInstance(a),
+	c := &Conn{
+		agentd:     a,
+		ip:         ip,
+		remoteAddr: remoteAddr,
+		conn:       conn.(*net.TCPConn),
+		r:          bufio.NewReader(conn),
+		w:          bufio.NewWriter(conn),
 
-		logger: log.New(os.Stderr, "", log.Flags()),
-		logLvl: LogLevelInfo,
+		proto: a.protocol.NewProtoInstance(a),
 
+		transactions:    make(map[uint32]*cmdTransaction),
 		transactionChan: make(chan *cmdTransaction),
 		msgResponseChan: make(chan Message),
+		heartbeatChan:   make(chan int, 1),
 		exitChan:        make(chan int),
 		drainReady:      make(chan int),
 	}
+	c.id.Store(remoteAddr)
+
+	opts := a.Options()
+	if opts.CapturePath != "" {
+		path := captureFileName(opts.CapturePath, remoteAddr)
+		w, err := a.captures.open(path, opts.CaptureMaxBytes, opts.CaptureMaxFiles)
+		if err != nil {
+			c.Log(LogLevelError, "failed to open capture file", "path", path, "err", err)
+		} else {
+			c.capture = w
+		}
+	}
+
+	if b, ok := c.proto.(ConnBinder); ok {
+		b.BindConn(c)
+	}
+	return c
 }
 
-// SetLogger assigns the logger to use as well as a level.
-//
-// The logger parameter is an interface that requires the following
-// method to be implemented (such as the the stdlib log.Logger):
-//
-//    Output(calldepth int, s string)
-//
-func (c *Conn) SetLogger(l logger, lvl LogLevel) {
-	c.logger = l
-	c.logLvl = lvl
+// ResetHeartbeat restarts the heartbeat timer so that a change to the
+// protocol's heartbeat interval takes effect
+func (c *Conn) ResetHeartbeat() {
+	select {
+	case c.heartbeatChan <- 1:
+	default:
+	}
 }
 
 func (c *Conn) Start() {
-	c.log(LogLevelInfo, "client connected")
+	c.Log(LogLevelInfo, "client connected", "addr", c.remoteAddr)
+	atomic.StoreInt64(&c.stats.connectTime, time.Now().UnixNano())
 	c.wg.Add(2)
 	atomic.StoreInt32(&c.readLoopRunning, 1)
 	go c.readLoop()
 	go c.writeLoop()
-	c.agentd.AddClient(c.addr, c)
+	c.agentd.AddClient(c)
+	c.publishLifecycle(LifecycleConnected, "", "")
+
+	// Exit may have missed the client while it was being added
+	if c.agentd.isStopping() {
+		c.stop()
+		return
+	}
+
+	if ider, ok := c.proto.(Identifier); ok {
+		go c.identifyLoop(ider)
+	}
+}
+
+// identifyLoop asks the protocol for the peer's device ID and registers
+// the client under it, retrying every heartbeat interval until it
+// succeeds or the connection closes
+func (c *Conn) identifyLoop(ider Identifier) {
+	defer c.recoverPanic("identifyLoop", nil)
+
+	for {
+		id, err := ider.Identify(c)
+		if err == nil {
+			err = c.agentd.SetClientID(c, id)
+			if err == nil {
+				c.Log(LogLevelInfo, "client identified", "addr", c.remoteAddr)
+				return
+			}
+		}
+		if err == ErrNotConnected || err == ErrStopped {
+			return
+		}
+		c.Log(LogLevelWarning, "failed to identify", "err", err)
+
+		select {
+		case <-time.After(c.proto.HeartbeatInterval()):
+		case <-c.exitChan:
+			return
+		}
+	}
 }
 
 // Close idempotently initiates connection close
 func (c *Conn) Close() error {
+	c.setCloseReason("closed by agentd")
 	atomic.StoreInt32(&c.closeFlag, 1)
 	return nil
 }
 
+// stop closes the connection as agentd shuts down. A message readLoop
+// is handling is handled in full first.
+func (c *Conn) stop() {
+	c.setCloseReason("agentd shutting down")
+	c.close()
+}
+
+// setCloseReason records why the connection is closing; the first
+// reason given sticks
+func (c *Conn) setCloseReason(reason string) {
+	c.closeReasonMtx.Lock()
+	defer c.closeReasonMtx.Unlock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+}
+
+// CloseReason returns why the connection closed, or an empty string
+// while it is open
+func (c *Conn) CloseReason() string {
+	c.closeReasonMtx.Lock()
+	defer c.closeReasonMtx.Unlock()
+	return c.closeReason
+}
+
 // IsClosing indicates whether or not the
 // connection is currently in the processing of
 // gracefully closing
@@ -152,9 +261,53 @@ func (c *Conn) IsClosing() bool {
 	return atomic.LoadInt32(&c.closeFlag) == 1
 }
 
-// String returns the remote address
+// ID returns the device ID of the client, which is its remote address
+// until the protocol has identified it
+func (c *Conn) ID() string {
+	return c.id.Load().(string)
+}
+
+// Stats returns a snapshot of the connection's counters
+func (c *Conn) Stats() ConnStats {
+	c.transactionsMtx.Lock()
+	inFlight := len(c.transactions)
+	c.transactionsMtx.Unlock()
+
+	stats := ConnStats{
+		ConnectTime:           time.Unix(0, atomic.LoadInt64(&c.stats.connectTime)),
+		HeartbeatRTT:          time.Duration(atomic.LoadInt64(&c.stats.heartbeatRTT)),
+		HeartbeatRTTHistogram: c.stats.heartbeatRTTs.buckets(),
+		HeartbeatRTTSum:       c.stats.heartbeatRTTs.total(),
+		HeartbeatsSent:        atomic.LoadUint64(&c.stats.heartbeatsSent),
+		HeartbeatsAnswered:    atomic.LoadUint64(&c.stats.heartbeatsAnswered),
+		HeartbeatsMissed:      atomic.LoadUint64(&c.stats.heartbeatsMissed),
+		ConsecutiveMisses:     atomic.LoadUint32(&c.stats.consecutiveMisses),
+		MessagesIn:            atomic.LoadUint64(&c.stats.messagesIn),
+		MessagesOut:           atomic.LoadUint64(&c.stats.messagesOut),
+		WriteErrors:           atomic.LoadUint64(&c.stats.writeErrors),
+		CommandTimeouts:       atomic.LoadUint64(&c.stats.commandTimeouts),
+		UnexpectedResponses:   atomic.LoadUint64(&c.stats.unexpectedResponses),
+		InFlight:              inFlight,
+	}
+	if t := atomic.LoadInt64(&c.stats.lastFrameTime); t != 0 {
+		stats.LastFrameTime = time.Unix(0, t)
+	}
+	return stats
+}
+
+// IP returns the IP address of the client
+func (c *Conn) IP() string {
+	return c.ip
+}
+
+// RemoteAddr returns the <addr>:<port> of the client
+func (c *Conn) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+// String returns the device ID
 func (c *Conn) String() string {
-	return c.addr
+	return c.ID()
 }
 
 func (c *Conn) ProtoInstance() ProtoInstance {
@@ -162,18 +315,42 @@ func (c *Conn) ProtoInstance() ProtoInstance {
 }
 
 func (c *Conn) Read(p []byte) (int, error) {
-	return c.r.Read(p)
+	n, err := c.r.Read(p)
+	if err != nil {
+		c.readErr = err
+	}
+	if c.capture != nil {
+		c.captureIn = append(c.captureIn, p[:n]...)
+	}
+	return n, err
 }
 
 func (c *Conn) Write(p []byte) (int, error) {
+	if c.capture != nil {
+		c.captureOut = append(c.captureOut, p...)
+	}
 	return c.w.Write(p)
 }
 
+// captureFrame writes the bytes read or written since the last call to
+// the capture file
+func (c *Conn) captureFrame(dir string, buf *[]byte) {
+	if c.capture == nil || len(*buf) == 0 {
+		return
+	}
+	err := c.capture.Write(CaptureRecord{Time: time.Now(), Dir: dir, Data: *buf})
+	if err != nil {
+		c.Log(LogLevelError, "failed to write capture file", "err", err)
+	}
+	*buf = (*buf)[:0]
+}
+
 // write a Message to this connection, and flush.
 func (c *Conn) WriteMessage(msg Message) error {
 	c.conn.SetWriteDeadline(time.Now().Add(c.proto.HeartbeatInterval()))
 
 	err := c.proto.WriteMessage(c, msg)
+	c.captureFrame(CaptureOut, &c.captureOut)
 	if err != nil {
 		goto exit
 	}
@@ -181,15 +358,24 @@ func (c *Conn) WriteMessage(msg Message) error {
 
 exit:
 	if err != nil {
-		c.log(LogLevelError, "IO error - %s", err)
+		atomic.AddUint64(&c.stats.writeErrors, 1)
+		c.Log(LogLevelError, "IO error", "err", err)
+		return err
 	}
-	return err
+	atomic.AddUint64(&c.stats.messagesOut, 1)
+	return nil
 }
 
 type flusher interface {
 	Flush() error
 }
 
+// commandTimeouter is implemented by protocols that want a timeout
+// other than AgentdOptions.CommandTimeout for some requests
+type commandTimeouter interface {
+	CommandTimeout(req Message) time.Duration
+}
+
 // Flush writes all buffered data to the underlying TCP connection
 func (c *Conn) Flush() error {
 	if f, ok := c.w.(flusher); ok {
@@ -198,56 +384,176 @@ func (c *Conn) Flush() error {
 	return nil
 }
 
+// commandTimeout returns how long to wait for the response to req
+func (c *Conn) commandTimeout(req Message) time.Duration {
+	if t, ok := c.proto.(commandTimeouter); ok {
+		if d := t.CommandTimeout(req); d > 0 {
+			return d
+		}
+	}
+	return c.agentd.Options().CommandTimeout
+}
+
+// SendCommand sends req and waits for its response, giving up after
+// the command timeout configured for req
 func (c *Conn) SendCommand(req Message) (Message, error) {
+	return c.SendCommandContext(context.Background(), req)
+}
+
+// SendCommandContext sends req and waits for its response until ctx is
+// done or the command timeout for req expires, whichever comes first.
+// ErrTimeout is returned when a deadline expires and ctx.Err() when ctx
+// is cancelled.
+func (c *Conn) SendCommandContext(ctx context.Context, req Message) (Message, error) {
 	atomic.AddInt32(&c.concurrentSenders, 1)
 
 	if atomic.LoadInt32(&c.closeFlag) == 1 {
 		atomic.AddInt32(&c.concurrentSenders, -1)
+		if c.agentd.isStopping() {
+			return nil, ErrStopped
+		}
 		return nil, ErrNotConnected
 	}
 
-	doneChan := make(chan *cmdTransaction)
+	if timeout := c.commandTimeout(req); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// buffered so that a response arriving after the sender gave up
+	// never blocks readLoop
+	doneChan := make(chan *cmdTransaction, 1)
+	start := time.Now()
 	trans := &cmdTransaction{
+		id:       c.proto.TransactionID(req),
 		req:      req,
 		doneChan: doneChan,
 	}
 
-	c.transactionChan <- trans
-	atomic.AddInt32(&c.concurrentSenders, -1)
+	select {
+	case c.transactionChan <- trans:
+		atomic.AddInt32(&c.concurrentSenders, -1)
+	case <-ctx.Done():
+		atomic.AddInt32(&c.concurrentSenders, -1)
+		return nil, contextErr(ctx)
+	}
 
-	t := <-doneChan
-	if t.resp == nil {
-		return nil, ErrInvalidResponse
+	select {
+	case t := <-doneChan:
+		if t.err != nil {
+			return nil, t.err
+		}
+		if t.resp == nil {
+			return nil, ErrInvalidResponse
+		}
+		c.observeCommand(req, time.Since(start))
+		return t.resp, nil
+	case <-ctx.Done():
+		c.abandonTransaction(trans)
+		c.Log(LogLevelWarning, "transaction abandoned", "transaction", fmt.Sprintf("%08x", trans.id), "err", ctx.Err())
+		err := contextErr(ctx)
+		if err == ErrTimeout {
+			atomic.AddUint64(&c.stats.commandTimeouts, 1)
+		}
+		return nil, err
 	}
-	return t.resp, nil
 }
 
+func contextErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+// pushTransaction records t as in flight, failing if its sender has
+// already given up or another request with the same transaction ID has
+// not been answered yet
+func (c *Conn) pushTransaction(t *cmdTransaction) error {
+	c.transactionsMtx.Lock()
+	defer c.transactionsMtx.Unlock()
+
+	if t.abandoned {
+		return errTransactionAbandoned
+	}
+	if _, ok := c.transactions[t.id]; ok {
+		return ErrTransactionInFlight
+	}
+	c.transactions[t.id] = t
+	return nil
+}
+
+// abandonTransaction forgets t so that its ID can be reused and a late
+// response to it is discarded
+func (c *Conn) abandonTransaction(t *cmdTransaction) {
+	c.transactionsMtx.Lock()
+	defer c.transactionsMtx.Unlock()
+
+	t.abandoned = true
+	if c.transactions[t.id] == t {
+		delete(c.transactions, t.id)
+	}
+}
+
+// popTransaction completes the in flight transaction matching resp.
+// Responses that match no outstanding request are logged and dropped.
 func (c *Conn) popTransaction(frameType int32, resp Message) {
-	t := c.transactions[0]
-	c.transactions = c.transactions[1:]
+	id := c.proto.TransactionID(resp)
+
+	c.transactionsMtx.Lock()
+	t, ok := c.transactions[id]
+	if ok {
+		delete(c.transactions, id)
+	}
+	c.transactionsMtx.Unlock()
 
+	if !ok {
+		atomic.AddUint64(&c.stats.unexpectedResponses, 1)
+		c.Log(LogLevelWarning, "discarding unexpected response", "resp", resp, "transaction", fmt.Sprintf("%08x", id))
+		return
+	}
+
+	if o, ok := c.proto.(ResponseObserver); ok {
+		o.ObserveResponse(t.req, resp)
+	}
 	t.resp = resp
 	t.finish()
 }
 
 func (c *Conn) readLoop() {
+	defer c.recoverPanic("readLoop", func() {
+		atomic.StoreInt32(&c.readLoopRunning, 0)
+		c.wg.Done()
+	})
+
 	for {
 		if atomic.LoadInt32(&c.closeFlag) == 1 {
 			goto exit
 		}
 
-		c.conn.SetReadDeadline(time.Now().Add(c.proto.HeartbeatInterval() * 2))
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout()))
 
 		frameType, msg, err := c.proto.DecodeMessage(c)
+		c.captureFrame(CaptureIn, &c.captureIn)
 		if err != nil {
 			if !strings.Contains(err.Error(), "use of closed network connection") {
-				c.log(LogLevelError, "IO error - %s", err)
+				c.Log(LogLevelError, "IO error", "err", err)
+			}
+			c.setCloseReason(c.readErrReason(err))
+			if c.readErr == nil {
+				c.publishLifecycle(LifecycleProtocolError, "", err.Error())
 			}
 			goto exit
 		}
 
+		now := time.Now().UnixNano()
+		atomic.StoreInt64(&c.stats.lastFrameTime, now)
+		atomic.AddUint64(&c.stats.messagesIn, 1)
+
 		switch frameType {
 		case FrameTypeMessage:
+			c.heartbeatAnswered(msg, now)
 			resp := c.proto.HandleMessage(msg)
 			if resp != nil {
 				c.msgResponseChan <- resp
@@ -255,8 +561,9 @@ func (c *Conn) readLoop() {
 		case FrameTypeResponse:
 			c.popTransaction(FrameTypeResponse, msg)
 		default:
-			c.log(LogLevelError, "IO error - %s", err)
-			c.log(LogLevelError, "unknown frame type %d", frameType)
+			c.Log(LogLevelError, "unknown frame type", "frameType", frameType)
+			c.setCloseReason(fmt.Sprintf("unknown frame type %d", frameType))
+			c.publishLifecycle(LifecycleProtocolError, "", fmt.Sprintf("unknown frame type %d", frameType))
 			goto exit
 		}
 	}
@@ -266,52 +573,143 @@ exit:
 	// start the connection close
 	c.close()
 	c.wg.Done()
-	c.log(LogLevelInfo, "readLoop exiting")
+	c.Log(LogLevelInfo, "readLoop exiting")
 }
 
 func (c *Conn) writeLoop() {
 	heartbeatTicker := time.NewTicker(c.proto.HeartbeatInterval())
+	defer c.recoverPanic("writeLoop", func() {
+		// cleanup waits on drainReady, see close()
+		close(c.drainReady)
+		heartbeatTicker.Stop()
+		c.wg.Done()
+	})
 
 	for {
 		select {
 		case <-c.exitChan:
-			c.log(LogLevelInfo, "breaking out of writeLoop")
+			c.Log(LogLevelInfo, "breaking out of writeLoop")
 			// Indicate drainReady because we will not pull any more off msgResponseChan
 			close(c.drainReady)
 			goto exit
 		case t := <-c.transactionChan:
-			c.transactions = append(c.transactions, t)
-			err := c.WriteMessage(t.req)
+			err := c.pushTransaction(t)
 			if err != nil {
-				c.log(LogLevelError, "error sending request %s - %s", t.req, err)
+				if err == ErrTransactionInFlight {
+					c.Log(LogLevelWarning, "transaction already in flight", "transaction", fmt.Sprintf("%08x", t.id))
+				}
+				t.err = err
+				t.finish()
+				continue
+			}
+			err = c.WriteMessage(t.req)
+			if err != nil {
+				c.Log(LogLevelError, "error sending request", "req", t.req, "err", err)
+				c.setCloseReason("write error - " + err.Error())
 				c.close()
 				continue
 			}
 		case resp := <-c.msgResponseChan:
 			err := c.WriteMessage(resp)
 			if err != nil {
-				c.log(LogLevelError, "error sending response %s - %s", resp, err)
+				c.Log(LogLevelError, "error sending response", "resp", resp, "err", err)
+				c.setCloseReason("write error - " + err.Error())
 				c.close()
 				continue
 			}
+		case <-c.heartbeatChan:
+			heartbeatTicker.Stop()
+			heartbeatTicker = time.NewTicker(c.proto.HeartbeatInterval())
 		case <-heartbeatTicker.C:
 			hb := c.proto.NewHeartbeatMsg()
 			if hb == nil {
 				continue
 			}
+			if !c.checkHeartbeat() {
+				continue
+			}
 			err := c.WriteMessage(hb)
 			if err != nil {
-				c.log(LogLevelError, "error sending heartbeat %s - %s", hb, err)
+				c.Log(LogLevelError, "error sending heartbeat", "req", hb, "err", err)
+				c.setCloseReason("write error - " + err.Error())
 				c.close()
 				continue
 			}
+			atomic.StoreUint32(&c.stats.heartbeatID, c.proto.TransactionID(hb))
+			atomic.StoreInt64(&c.stats.heartbeatSent, time.Now().UnixNano())
+			atomic.AddUint64(&c.stats.heartbeatsSent, 1)
 		}
 	}
 
 exit:
 	heartbeatTicker.Stop()
 	c.wg.Done()
-	c.log(LogLevelInfo, "writeLoop exiting")
+	c.Log(LogLevelInfo, "writeLoop exiting")
+}
+
+// heartbeatAnswered records the round trip time if msg answers the
+// last heartbeat sent
+func (c *Conn) heartbeatAnswered(msg Message, now int64) {
+	sent := atomic.LoadInt64(&c.stats.heartbeatSent)
+	if sent == 0 || c.proto.TransactionID(msg) != atomic.LoadUint32(&c.stats.heartbeatID) {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&c.stats.heartbeatSent, sent, 0) {
+		atomic.StoreInt64(&c.stats.heartbeatRTT, now-sent)
+		atomic.StoreUint32(&c.stats.consecutiveMisses, 0)
+		atomic.AddUint64(&c.stats.heartbeatsAnswered, 1)
+		c.stats.heartbeatRTTs.observe(time.Duration(now - sent))
+	}
+}
+
+// checkHeartbeat counts the last heartbeat sent as missed if it has not
+// been answered by the time the next one is due, and closes the
+// connection once HeartbeatMissThreshold heartbeats in a row have been
+// missed. It returns false if the connection is closing.
+func (c *Conn) checkHeartbeat() bool {
+	sent := atomic.LoadInt64(&c.stats.heartbeatSent)
+	if sent == 0 || !atomic.CompareAndSwapInt64(&c.stats.heartbeatSent, sent, 0) {
+		return true
+	}
+
+	misses := atomic.AddUint32(&c.stats.consecutiveMisses, 1)
+	atomic.AddUint64(&c.stats.heartbeatsMissed, 1)
+	c.Log(LogLevelWarning, "heartbeat not answered",
+		"transaction", fmt.Sprintf("%08x", atomic.LoadUint32(&c.stats.heartbeatID)), "misses", misses)
+	c.publishLifecycle(LifecycleHeartbeatMissed, "", fmt.Sprintf("%d in a row", misses))
+
+	threshold := c.agentd.Options().HeartbeatMissThreshold
+	if int(misses) < threshold {
+		return true
+	}
+	c.setCloseReason(fmt.Sprintf("%d heartbeats in a row not answered", misses))
+	c.close()
+	return false
+}
+
+// readTimeout is how long readLoop waits for a frame. A heartbeat is
+// only counted as missed when the next one is due, so this leaves room
+// for HeartbeatMissThreshold misses and one interval more; it only
+// closes connections whose protocol has no heartbeat.
+func (c *Conn) readTimeout() time.Duration {
+	threshold := c.agentd.Options().HeartbeatMissThreshold
+	return c.proto.HeartbeatInterval() * time.Duration(threshold+2)
+}
+
+// readErrReason describes why readLoop failed with err, preferring
+// the error from the underlying connection, which protocols tend to
+// hide behind their own errors
+func (c *Conn) readErrReason(err error) string {
+	if c.readErr == nil {
+		return "protocol error - " + err.Error()
+	}
+	if c.readErr == io.EOF {
+		return "closed by peer"
+	}
+	if nerr, ok := c.readErr.(net.Error); ok && nerr.Timeout() {
+		return fmt.Sprintf("no frame received for %s", c.readTimeout())
+	}
+	return "read error - " + c.readErr.Error()
 }
 
 func (c *Conn) close() {
@@ -334,10 +732,10 @@ func (c *Conn) close() {
 	//            and cleanup goroutine)
 	//         c. underlying TCP connection close
 	//
-	c.agentd.RemoveClient(c.addr)
+	c.agentd.RemoveClient(c)
 
 	c.stopper.Do(func() {
-		c.log(LogLevelInfo, "beginning close")
+		c.Log(LogLevelInfo, "beginning close")
 		atomic.StoreInt32(&c.closeFlag, 1)
 		close(c.exitChan)
 		c.conn.CloseRead()
@@ -370,16 +768,26 @@ func (c *Conn) cleanup() {
 exit:
 	c.transactionCleanup()
 	c.wg.Done()
-	c.log(LogLevelInfo, "finished draining, cleanup exiting")
+	c.Log(LogLevelInfo, "finished draining, cleanup exiting")
 }
 
 func (c *Conn) transactionCleanup() {
+	// senders are told about a shutdown, anything else leaves them with
+	// no response
+	var err error
+	if c.agentd.isStopping() {
+		err = ErrStopped
+	}
+
 	// clean up transactions we can easily account for
-	for _, t := range c.transactions {
+	c.transactionsMtx.Lock()
+	for id, t := range c.transactions {
+		delete(c.transactions, id)
 		t.resp = nil
+		t.err = err
 		t.finish()
 	}
-	c.transactions = c.transactions[:0]
+	c.transactionsMtx.Unlock()
 
 	// spin and free up any writes that might have raced
 	// with the cleanup process (blocked on writing
@@ -388,6 +796,7 @@ func (c *Conn) transactionCleanup() {
 		select {
 		case t := <-c.transactionChan:
 			t.resp = nil
+			t.err = err
 			t.finish()
 		default:
 			// keep spinning until there are 0 concurrent senders
@@ -407,19 +816,25 @@ func (c *Conn) waitForCleanup() {
 	c.wg.Wait()
 	//c.conn.CloseWrite()
 	c.conn.Close()
-	c.log(LogLevelInfo, "clean close complete")
-}
+	if c.capture != nil {
+		c.agentd.captures.close(c.capture)
+	}
+	c.setCloseReason("connection closed")
+	c.Log(LogLevelInfo, "clean close complete", "reason", c.CloseReason())
+	c.publishLifecycle(LifecycleDisconnected, "", c.CloseReason())
 
-func (c *Conn) log(lvl LogLevel, line string, args ...interface{}) {
-	if c.logger == nil {
-		return
+	if o, ok := c.agentd.protocol.(ClientObserver); ok {
+		o.ClientClosed(c, c.CloseReason())
 	}
+	c.agentd.clientsWaitGroup.Done()
+}
 
-	if c.logLvl > lvl {
+// Log writes a record about the connection at lvl, with the device ID
+// under the key rsu
+func (c *Conn) Log(lvl LogLevel, msg string, kv ...interface{}) {
+	l := DefaultLogger()
+	if !l.Enabled(lvl) {
 		return
 	}
-
-	c.logger.Output(2, fmt.Sprintf("%-4s %s %s", logPrefix(lvl),
-		fmt.Sprintf("(%s)", c.String()),
-		fmt.Sprintf(line, args...)))
+	l.Log(lvl, msg, append([]interface{}{"rsu", c.ID()}, kv...)...)
 }
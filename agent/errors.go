@@ -11,8 +11,20 @@ var ErrNotConnected = errors.New("not connected")
 
 var ErrInvalidResponse = errors.New("invalid response")
 
-// ErrStopped is returned when a publish command is
-// made against a Producer that has been stopped
+// ErrTimeout is returned from SendCommandContext when no response
+// arrives before the command timeout or the context deadline
+var ErrTimeout = errors.New("command timed out")
+
+// ErrTransactionInFlight is returned from SendCommand when a request
+// with the same transaction ID is already awaiting its response
+var ErrTransactionInFlight = errors.New("transaction already in flight")
+
+// errTransactionAbandoned marks a transaction whose sender gave up
+// before writeLoop got around to sending it
+var errTransactionAbandoned = errors.New("transaction abandoned")
+
+// ErrStopped is returned when a command is sent to a client of an
+// agentd that is shutting down
 var ErrStopped = errors.New("stopped")
 
 // ErrAlreadyConnected is returned from ConnectToNSQD when already connected
@@ -31,6 +43,30 @@ func (e ErrIdentify) Error() string {
 	return fmt.Sprintf("failed to IDENTIFY - %s", e.Reason)
 }
 
+// ErrOption is returned from AgentdOptions.Validate for an option
+// with an unusable value
+type ErrOption struct {
+	Key    string
+	Reason string
+}
+
+// Error returns a stringified error
+func (e ErrOption) Error() string {
+	return fmt.Sprintf("invalid option %s - %s", e.Key, e.Reason)
+}
+
+// ErrPermanent wraps an error delivering an event that retrying cannot
+// fix, such as an event the receiver rejects. An Outbox moves the
+// record to its dead letter file instead of retrying it.
+type ErrPermanent struct {
+	Err error
+}
+
+// Error returns a stringified error
+func (e ErrPermanent) Error() string {
+	return e.Err.Error()
+}
+
 // ErrProtocol is returned from Producer when encountering
 // an NSQ protocol level error
 type ErrProtocol struct {
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// heartbeatRTTBuckets are the upper bounds of the heartbeat round trip
+// time histogram buckets
+var heartbeatRTTBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// HistogramBucket counts the observations greater than the upper bound
+// of the previous bucket and at most UpperBound. The last bucket of a
+// histogram has no upper bound and a zero UpperBound.
+type HistogramBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// rttHistogram counts round trip times; safe for concurrent use
+type rttHistogram struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	sum    int64
+	counts [len(heartbeatRTTBuckets) + 1]uint64
+}
+
+func (h *rttHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(heartbeatRTTBuckets) && d > heartbeatRTTBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// buckets returns a snapshot of the histogram
+func (h *rttHistogram) buckets() []HistogramBucket {
+	buckets := make([]HistogramBucket, len(h.counts))
+	for i := range h.counts {
+		if i < len(heartbeatRTTBuckets) {
+			buckets[i].UpperBound = heartbeatRTTBuckets[i]
+		}
+		buckets[i].Count = atomic.LoadUint64(&h.counts[i])
+	}
+	return buckets
+}
+
+// total returns the sum of all observations
+func (h *rttHistogram) total() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.sum))
+}
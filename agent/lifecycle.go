@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Connection lifecycle events, published under
+// AgentdOptions.LifecycleTopic
+const (
+	LifecycleConnected       = "connected"
+	LifecycleIdentified      = "identified"
+	LifecycleDisconnected    = "disconnected"
+	LifecycleHeartbeatMissed = "heartbeat_missed"
+	LifecycleProtocolError   = "protocol_error"
+)
+
+// LifecycleEvent reports a change in the state of a client connection
+type LifecycleEvent struct {
+	Event     string `json:"Event"`
+	Timestamp int64  `json:"Timestamp"`
+	// ID is the device ID of the client, its remote address until the
+	// protocol has identified it
+	ID     string `json:"ID"`
+	IP     string `json:"IP"`
+	Addr   string `json:"Addr"`
+	OldID  string `json:"OldID,omitempty"`
+	Reason string `json:"Reason,omitempty"`
+}
+
+// publishLifecycle publishes a lifecycle event about c, unless the
+// lifecycle topic is empty
+func (c *Conn) publishLifecycle(event string, oldID string, reason string) {
+	topic := c.agentd.Options().LifecycleTopic
+	if topic == "" {
+		return
+	}
+
+	buf, _ := json.Marshal(&LifecycleEvent{
+		Event:     event,
+		Timestamp: time.Now().Unix(),
+		ID:        c.ID(),
+		IP:        c.ip,
+		Addr:      c.remoteAddr,
+		OldID:     oldID,
+		Reason:    reason,
+	})
+	err := c.agentd.Publish(topic, buf)
+	if err != nil {
+		c.Log(LogLevelError, "failed to publish lifecycle event", "event", event, "err", err)
+	}
+}
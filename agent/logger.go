@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogLevel specifies the severity of a given log message
+type LogLevel int
+
+// logging constants
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+)
+
+func (lvl LogLevel) String() string {
+	switch lvl {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarning:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	}
+	return strconv.Itoa(int(lvl))
+}
+
+// ParseLogLevel returns the LogLevel named by s: debug, info, warn or
+// error
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarning, nil
+	case "error":
+		return LogLevelError, nil
+	}
+	return LogLevelInfo, fmt.Errorf("invalid log level %q (want debug, info, warn or error)", s)
+}
+
+// log output formats
+const (
+	LogFormatLogfmt int32 = iota
+	LogFormatJSON
+)
+
+// ParseLogFormat returns the log format named by s: logfmt or json
+func ParseLogFormat(s string) (int32, error) {
+	switch strings.ToLower(s) {
+	case "logfmt":
+		return LogFormatLogfmt, nil
+	case "json":
+		return LogFormatJSON, nil
+	}
+	return LogFormatLogfmt, fmt.Errorf("invalid log format %q (want logfmt or json)", s)
+}
+
+// Logger writes leveled records, each a message followed by key/value
+// fields, as logfmt or JSON lines. Loggers derived with With share the
+// output, level and format of their parent.
+type Logger struct {
+	core   *logCore
+	fields []interface{}
+}
+
+type logCore struct {
+	sync.Mutex
+	w      io.Writer
+	lvl    int32
+	format int32
+}
+
+var defaultLogger = NewLogger(os.Stderr, LogLevelInfo, LogFormatLogfmt)
+
+// DefaultLogger returns the logger shared by agentd and its protocols.
+// AgentD sets its level and format from the options.
+func DefaultLogger() *Logger {
+	return defaultLogger
+}
+
+// SetLogOptions sets the level and format of the default logger from
+// validated options
+func SetLogOptions(opts *AgentdOptions) {
+	lvl, _ := ParseLogLevel(opts.LogLevel)
+	format, _ := ParseLogFormat(opts.LogFormat)
+	defaultLogger.SetLevel(lvl)
+	defaultLogger.SetFormat(format)
+}
+
+func NewLogger(w io.Writer, lvl LogLevel, format int32) *Logger {
+	return &Logger{
+		core: &logCore{
+			w:      w,
+			lvl:    int32(lvl),
+			format: format,
+		},
+	}
+}
+
+// SetLevel changes the level below which records are dropped
+func (l *Logger) SetLevel(lvl LogLevel) {
+	atomic.StoreInt32(&l.core.lvl, int32(lvl))
+}
+
+func (l *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.core.lvl))
+}
+
+// SetFormat selects LogFormatLogfmt or LogFormatJSON
+func (l *Logger) SetFormat(format int32) {
+	atomic.StoreInt32(&l.core.format, format)
+}
+
+// Enabled reports whether records at lvl are written, so that callers
+// can skip building expensive fields
+func (l *Logger) Enabled(lvl LogLevel) bool {
+	return lvl >= l.Level()
+}
+
+// With returns a logger adding the key/value pairs kv to every record
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{
+		core:   l.core,
+		fields: fields,
+	}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.Log(LogLevelDebug, msg, kv...)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.Log(LogLevelInfo, msg, kv...)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.Log(LogLevelWarning, msg, kv...)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.Log(LogLevelError, msg, kv...)
+}
+
+// Log writes a record at lvl made up of msg and the key/value pairs of
+// the logger followed by kv
+func (l *Logger) Log(lvl LogLevel, msg string, kv ...interface{}) {
+	if !l.Enabled(lvl) {
+		return
+	}
+
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	fields = append(fields, "ts", time.Now().Format(time.RFC3339Nano), "level", lvl.String(), "msg", msg)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+
+	var buf bytes.Buffer
+	if atomic.LoadInt32(&l.core.format) == LogFormatJSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	l.core.Lock()
+	l.core.w.Write(buf.Bytes())
+	l.core.Unlock()
+}
+
+// logValue turns errors, Stringers and durations into strings
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+
+		s := fmt.Sprint(logValue(fields[i+1]))
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		val, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			val, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+}
@@ -18,10 +18,51 @@ type Protocol interface {
 	NewProtoInstance(a *AgentD) ProtoInstance
 }
 
+// ClientObserver is implemented by protocols that keep track of their
+// clients beyond the lifetime of a connection
+type ClientObserver interface {
+	// ClientIdentified is called once c is registered under its device
+	// ID, replacing oldID (the remote address at first)
+	ClientIdentified(c *Conn, oldID string)
+	// ClientClosed is called once c is closed
+	ClientClosed(c *Conn, reason string)
+}
+
+// Drainer is implemented by protocols that deliver events in the
+// background, for AgentD.Exit to wait for once every client is gone
+type Drainer interface {
+	// Drain waits until deadline for the pending events to be delivered,
+	// returning an error that says what is left if they were not
+	Drain(deadline time.Time) error
+}
+
 type ProtoInstance interface {
 	DecodeMessage(r io.Reader) (int32, Message, error)
 	HandleMessage(msg Message) Message
 	WriteMessage(w io.Writer, msg Message) error
+	// TransactionID returns the key that pairs a request with the
+	// response it elicits; both must map to the same value.
+	TransactionID(msg Message) uint32
 	NewHeartbeatMsg() Message
 	HeartbeatInterval() time.Duration
 }
+
+// ResponseObserver is implemented by protocol instances that want to
+// see every command and the response it got, for instance to cache
+// device settings
+type ResponseObserver interface {
+	ObserveResponse(req Message, resp Message)
+}
+
+// Identifier is implemented by protocol instances that can learn a
+// stable device ID from the peer once the connection is up, such as a
+// serial number. Until then the client is known by its remote address.
+type Identifier interface {
+	Identify(c *Conn) (string, error)
+}
+
+// ConnBinder is implemented by protocol instances that need the Conn
+// they serve, for instance to log under its device ID
+type ConnBinder interface {
+	BindConn(c *Conn)
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+var (
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "agentd",
+		Name:      "command_duration_seconds",
+		Help:      "Time from sending a command to receiving its response, by request type.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"type"})
+
+	sinkPublishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "agentd",
+		Name:      "sink_publish_failures_total",
+		Help:      "Events an event sink failed to accept, by sink.",
+	}, []string{"sink"})
+
+	outboxCorruptRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "agentd",
+		Name:      "outbox_corrupt_records_total",
+		Help:      "Corrupt records skipped in an outbox, by outbox. A run of corrupt records counts once.",
+	}, []string{"outbox"})
+
+	outboxDeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "agentd",
+		Name:      "outbox_dead_letters_total",
+		Help:      "Records moved to the dead letter file of an outbox because they cannot be delivered, by outbox.",
+	}, []string{"outbox"})
+
+	panics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "agentd",
+		Name:      "panics_total",
+		Help:      "Panics recovered, by the goroutine or handler they occurred in.",
+	}, []string{"where"})
+)
+
+func init() {
+	prometheus.MustRegister(commandDuration, sinkPublishFailures, outboxCorruptRecords, outboxDeadLetters, panics)
+}
+
+// messageTyper is implemented by protocols that label metrics with the
+// type of a message
+type messageTyper interface {
+	MessageType(msg Message) string
+}
+
+// observeCommand records the round trip time of a command
+func (c *Conn) observeCommand(req Message, d time.Duration) {
+	var typ string
+	if t, ok := c.proto.(messageTyper); ok {
+		typ = t.MessageType(req)
+	}
+	commandDuration.WithLabelValues(typ).Observe(d.Seconds())
+}
+
+var (
+	clientsDesc = prometheus.NewDesc("agentd_connected_clients",
+		"Number of connected clients.", nil, nil)
+	inFlightDesc = prometheus.NewDesc("agentd_transactions_in_flight",
+		"Commands sent to a client and not answered yet.", []string{"client"}, nil)
+	heartbeatRTTDesc = prometheus.NewDesc("agentd_heartbeat_rtt_seconds",
+		"Round trip time of answered heartbeats.", []string{"client"}, nil)
+	heartbeatsMissedDesc = prometheus.NewDesc("agentd_heartbeats_missed_total",
+		"Heartbeats not answered before the next one was due.", []string{"client"}, nil)
+)
+
+// Collector exports the state of the clients connected to an AgentD,
+// labelled with their device IDs
+type Collector struct {
+	agentd *AgentD
+}
+
+func NewCollector(a *AgentD) *Collector {
+	return &Collector{a}
+}
+
+func (col *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientsDesc
+	ch <- inFlightDesc
+	ch <- heartbeatRTTDesc
+	ch <- heartbeatsMissedDesc
+}
+
+func (col *Collector) Collect(ch chan<- prometheus.Metric) {
+	a := col.agentd
+	a.RLock()
+	clients := make([]*Conn, 0, len(a.Clients))
+	for _, c := range a.Clients {
+		clients = append(clients, c)
+	}
+	a.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(clientsDesc, prometheus.GaugeValue, float64(len(clients)))
+
+	for _, c := range clients {
+		id := c.ID()
+		stats := c.Stats()
+		ch <- prometheus.MustNewConstMetric(inFlightDesc, prometheus.GaugeValue,
+			float64(stats.InFlight), id)
+		ch <- prometheus.MustNewConstMetric(heartbeatsMissedDesc, prometheus.CounterValue,
+			float64(stats.HeartbeatsMissed), id)
+
+		// prometheus buckets are cumulative and leave out +Inf
+		var count uint64
+		buckets := make(map[float64]uint64)
+		for _, b := range stats.HeartbeatRTTHistogram {
+			count += b.Count
+			if b.UpperBound > 0 {
+				buckets[b.UpperBound.Seconds()] = count
+			}
+		}
+		ch <- prometheus.MustNewConstHistogram(heartbeatRTTDesc, count,
+			stats.HeartbeatRTTSum.Seconds(), buckets, id)
+	}
+}
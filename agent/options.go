@@ -1,15 +1,212 @@
 package agent
 
-import ()
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
 
 type AgentdOptions struct {
-	TcpAddress string `flag:"tcp-address"`
+	TcpAddress  string `flag:"tcp-address"`
+	HttpAddress string `flag:"http-address"`
+	SwaggerPath string `flag:"swagger-path"`
+
+	HeartbeatInterval      time.Duration `flag:"heartbeat-interval"`
+	HeartbeatMissThreshold int           `flag:"heartbeat-miss-threshold"`
+
+	LogLevel  string `flag:"log-level"`
+	LogFormat string `flag:"log-format"`
+
+	CommandTimeout      time.Duration `flag:"command-timeout"`
+	TypeCommandTimeouts []string      `flag:"type-command-timeout"`
+
+	FrameErrorPolicy string `flag:"frame-error-policy"`
+
+	EventSinks     string        `flag:"event-sink"`
+	KafkaBrokers   string        `flag:"kafka-brokers"`
+	EventFile      string        `flag:"event-file"`
+	WebhookURL     string        `flag:"webhook-url"`
+	WebhookTimeout time.Duration `flag:"webhook-timeout"`
+
+	LifecycleTopic string `flag:"lifecycle-topic"`
+
+	Store        string        `flag:"store"`
+	MongoAddress string        `flag:"mongo-address"`
+	EventTTL     time.Duration `flag:"event-ttl"`
+
+	DataPath         string        `flag:"data-path"`
+	OutboxMaxBytes   int64         `flag:"outbox-max-bytes"`
+	OutboxMaxBackoff time.Duration `flag:"outbox-max-backoff"`
+
+	CapturePath     string `flag:"capture-path"`
+	CaptureMaxBytes int64  `flag:"capture-max-bytes"`
+	CaptureMaxFiles int    `flag:"capture-max-files"`
+
+	ShutdownTimeout time.Duration `flag:"shutdown-timeout"`
 }
 
 func NewAgentdOptions() *AgentdOptions {
 	o := &AgentdOptions{
-		TcpAddress: "0.0.0.0:3002",
+		TcpAddress:  "0.0.0.0:3002",
+		HttpAddress: "0.0.0.0:8080",
+		SwaggerPath: "/root/go/src/github.com/wordnik/swagger-ui/dist",
+
+		HeartbeatInterval:      5 * time.Second,
+		HeartbeatMissThreshold: 2,
+
+		LogLevel:  "info",
+		LogFormat: "logfmt",
+
+		CommandTimeout: 5 * time.Second,
+
+		FrameErrorPolicy: "drop",
+
+		EventSinks:     "kafka",
+		KafkaBrokers:   "localhost:9092",
+		WebhookTimeout: 5 * time.Second,
+
+		LifecycleTopic: "lifecycle_event",
+
+		Store:        "mongo",
+		MongoAddress: "localhost",
+		EventTTL:     7 * 24 * time.Hour,
+
+		OutboxMaxBytes:   100 * 1024 * 1024,
+		OutboxMaxBackoff: 30 * time.Second,
+
+		CaptureMaxBytes: 10 * 1024 * 1024,
+		CaptureMaxFiles: 5,
+
+		ShutdownTimeout: 10 * time.Second,
 	}
 
 	return o
 }
+
+// Validate checks the options that their types alone do not constrain.
+// The returned error names the offending option.
+func (o *AgentdOptions) Validate() error {
+	if _, err := net.ResolveTCPAddr("tcp", o.TcpAddress); err != nil {
+		return ErrOption{"tcp-address", err.Error()}
+	}
+	if _, err := net.ResolveTCPAddr("tcp", o.HttpAddress); err != nil {
+		return ErrOption{"http-address", err.Error()}
+	}
+	if o.HeartbeatInterval < time.Second {
+		return ErrOption{"heartbeat-interval", "must be at least 1s"}
+	}
+	if o.HeartbeatMissThreshold < 1 {
+		return ErrOption{"heartbeat-miss-threshold", "must be at least 1"}
+	}
+	if _, err := ParseLogLevel(o.LogLevel); err != nil {
+		return ErrOption{"log-level", err.Error()}
+	}
+	if _, err := ParseLogFormat(o.LogFormat); err != nil {
+		return ErrOption{"log-format", err.Error()}
+	}
+	if o.CommandTimeout <= 0 {
+		return ErrOption{"command-timeout", "must be positive"}
+	}
+
+	for _, name := range strings.Split(o.EventSinks, ",") {
+		switch strings.TrimSpace(name) {
+		case "", "kafka", "nop":
+		case "file":
+			if o.EventFile == "" {
+				return ErrOption{"event-file", "required by the file event sink"}
+			}
+		case "webhook":
+			if o.WebhookURL == "" {
+				return ErrOption{"webhook-url", "required by the webhook event sink"}
+			}
+		default:
+			return ErrOption{"event-sink", fmt.Sprintf("unknown sink %q (want kafka, file, webhook or nop)", name)}
+		}
+	}
+	if o.WebhookTimeout <= 0 {
+		return ErrOption{"webhook-timeout", "must be positive"}
+	}
+
+	switch o.Store {
+	case "mongo", "file":
+	default:
+		return ErrOption{"store", fmt.Sprintf("unknown store %q (want mongo or file)", o.Store)}
+	}
+	if o.EventTTL <= 0 {
+		return ErrOption{"event-ttl", "must be positive"}
+	}
+
+	if o.OutboxMaxBytes < 0 {
+		return ErrOption{"outbox-max-bytes", "must not be negative"}
+	}
+	if o.OutboxMaxBackoff <= 0 {
+		return ErrOption{"outbox-max-backoff", "must be positive"}
+	}
+
+	if o.CapturePath != "" {
+		fi, err := os.Stat(o.CapturePath)
+		if err != nil {
+			return ErrOption{"capture-path", err.Error()}
+		}
+		if !fi.IsDir() {
+			return ErrOption{"capture-path", "not a directory"}
+		}
+	}
+	if o.CaptureMaxBytes < 0 {
+		return ErrOption{"capture-max-bytes", "must not be negative"}
+	}
+	if o.CaptureMaxFiles < 0 {
+		return ErrOption{"capture-max-files", "must not be negative"}
+	}
+
+	if o.ShutdownTimeout < 0 {
+		return ErrOption{"shutdown-timeout", "must not be negative"}
+	}
+	return nil
+}
+
+// startupOptions are only read when agentd starts; AgentD.Reload cannot
+// apply changes to them
+var startupOptions = map[string]bool{
+	"tcp-address":        true,
+	"http-address":       true,
+	"swagger-path":       true,
+	"store":              true,
+	"mongo-address":      true,
+	"event-ttl":          true,
+	"data-path":          true,
+	"outbox-max-bytes":   true,
+	"outbox-max-backoff": true,
+}
+
+// keepStartupOptions resets the startup options in opts that differ
+// from old back to their old values and returns their names
+func keepStartupOptions(old *AgentdOptions, opts *AgentdOptions) []string {
+	var changed []string
+
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(opts).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		key := ov.Type().Field(i).Tag.Get("flag")
+		if !startupOptions[key] {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			changed = append(changed, key)
+			nv.Field(i).Set(ov.Field(i))
+		}
+	}
+	return changed
+}
+
+// sinkOptionsChanged reports whether the event sinks need rebuilding
+func sinkOptionsChanged(old *AgentdOptions, opts *AgentdOptions) bool {
+	return old.EventSinks != opts.EventSinks ||
+		old.KafkaBrokers != opts.KafkaBrokers ||
+		old.EventFile != opts.EventFile ||
+		old.WebhookURL != opts.WebhookURL ||
+		old.WebhookTimeout != opts.WebhookTimeout
+}
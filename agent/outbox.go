@@ -0,0 +1,602 @@
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOutboxFull is returned from Outbox.Put when accepting the record
+// would exceed the configured size limit
+var ErrOutboxFull = errors.New("outbox full")
+
+const (
+	outboxSegmentBytes = 16 << 20
+	outboxMinBackoff   = 100 * time.Millisecond
+
+	// record header: 4 byte length of the rest, 4 byte CRC32 of the rest
+	outboxHeaderLen = 8
+)
+
+// OutboxHandler delivers one record. A non-nil error leaves the record
+// at the head of the outbox to be retried, unless it is an
+// ErrPermanent: the record is then moved to the dead letter file.
+type OutboxHandler func(topic string, body []byte) error
+
+// Outbox is a disk-backed FIFO sitting between event decoding and
+// delivery. Records are appended to segment files under a directory and
+// handed to the handler in order; a record is only discarded once the
+// handler succeeds, so delivery is at-least-once across outages and
+// restarts. Failed deliveries are retried with exponential backoff.
+// Records the handler rejects for good are appended to a dead letter
+// file, <name>.outbox.dead, as JSON lines for an operator to look into,
+// so that they do not hold up the records behind them.
+type Outbox struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	depth int64
+	bytes int64
+
+	sync.Mutex
+
+	name       string
+	dir        string
+	maxBytes   int64
+	maxBackoff time.Duration
+	handler    OutboxHandler
+
+	readSeq   int64
+	readPos   int64
+	readFile  *os.File
+	writeSeq  int64
+	writePos  int64
+	writeFile *os.File
+
+	writeChan chan int
+	exitChan  chan int
+	exitFlag  int32
+	wg        sync.WaitGroup
+
+	logger *Logger
+}
+
+// NewOutbox opens (or creates) the outbox called name under dir and
+// starts delivering any records left over from a previous run.
+// A maxBytes of zero leaves the outbox unbounded.
+func NewOutbox(name string, dir string, maxBytes int64, maxBackoff time.Duration, handler OutboxHandler) (*Outbox, error) {
+	o := &Outbox{
+		name:       name,
+		dir:        dir,
+		maxBytes:   maxBytes,
+		maxBackoff: maxBackoff,
+		handler:    handler,
+		writeChan:  make(chan int, 1),
+		exitChan:   make(chan int),
+		logger:     DefaultLogger().With("outbox", name),
+	}
+	if o.maxBackoff < outboxMinBackoff {
+		o.maxBackoff = outboxMinBackoff
+	}
+
+	if o.dir == "" {
+		o.dir = "."
+	}
+
+	err := os.MkdirAll(o.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = o.load()
+	if err != nil {
+		o.closeFiles()
+		return nil, err
+	}
+
+	if o.Depth() > 0 {
+		o.logger.Info("replaying records", "records", o.Depth(), "bytes", atomic.LoadInt64(&o.bytes))
+	}
+
+	o.wg.Add(1)
+	go o.deliverLoop()
+
+	return o, nil
+}
+
+// Put appends a record to the outbox. The record is on disk when Put
+// returns nil.
+func (o *Outbox) Put(topic string, body []byte) error {
+	rec := encodeOutboxRecord(topic, body)
+	n := int64(len(rec))
+
+	o.Lock()
+	defer o.Unlock()
+
+	if atomic.LoadInt32(&o.exitFlag) == 1 {
+		return ErrStopped
+	}
+	if o.maxBytes > 0 && atomic.LoadInt64(&o.bytes)+n > o.maxBytes {
+		return ErrOutboxFull
+	}
+
+	if o.writePos > 0 && o.writePos+n > outboxSegmentBytes {
+		err := o.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := o.writeFile.Write(rec)
+	if err == nil {
+		err = o.writeFile.Sync()
+	}
+	if err != nil {
+		// drop whatever part of the record made it out
+		o.writeFile.Truncate(o.writePos)
+		o.writeFile.Seek(o.writePos, 0)
+		return err
+	}
+	o.writePos += n
+	atomic.AddInt64(&o.depth, 1)
+	atomic.AddInt64(&o.bytes, n)
+
+	select {
+	case o.writeChan <- 1:
+	default:
+	}
+	return nil
+}
+
+// Depth returns the number of records awaiting delivery
+func (o *Outbox) Depth() int64 {
+	return atomic.LoadInt64(&o.depth)
+}
+
+// Flush waits until every record has been delivered or deadline
+// passes, whichever comes first, and returns the number of records
+// left
+func (o *Outbox) Flush(deadline time.Time) int64 {
+	for {
+		depth := o.Depth()
+		if depth == 0 || !time.Now().Before(deadline) {
+			return depth
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Close stops delivery. Records not yet delivered stay on disk and are
+// replayed by the next NewOutbox on the same directory.
+func (o *Outbox) Close() error {
+	o.Lock()
+	if !atomic.CompareAndSwapInt32(&o.exitFlag, 0, 1) {
+		o.Unlock()
+		return nil
+	}
+	o.Unlock()
+
+	close(o.exitChan)
+	o.wg.Wait()
+
+	o.Lock()
+	defer o.Unlock()
+	err := o.persistMeta()
+	o.closeFiles()
+	return err
+}
+
+func (o *Outbox) deliverLoop() {
+	var backoff time.Duration
+
+	for {
+		topic, body, n, err := o.peek()
+		if err == io.EOF {
+			select {
+			case <-o.writeChan:
+				continue
+			case <-o.exitChan:
+				goto exit
+			}
+		}
+		if err != nil {
+			o.logger.Error("failed to read record", "err", err)
+		} else {
+			err = o.handler(topic, body)
+			if err == nil {
+				backoff = 0
+				o.advance(n)
+				continue
+			}
+			if perm, ok := err.(ErrPermanent); ok {
+				o.logger.Error("moving undeliverable record to the dead letter file", "topic", topic, "err", perm.Err)
+				err = o.deadLetter(topic, body, perm.Err)
+				if err == nil {
+					backoff = 0
+					o.advance(n)
+					continue
+				}
+				o.logger.Error("failed to write dead letter file", "err", err)
+			} else {
+				o.logger.Error("failed to deliver record", "topic", topic, "err", err)
+			}
+		}
+
+		backoff *= 2
+		if backoff < outboxMinBackoff {
+			backoff = outboxMinBackoff
+		}
+		if backoff > o.maxBackoff {
+			backoff = o.maxBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-o.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	o.wg.Done()
+}
+
+// peek returns the record at the head of the outbox along with its
+// size on disk, or io.EOF when the outbox is empty. Corrupt records are
+// skipped and counted rather than left to block the records behind
+// them.
+func (o *Outbox) peek() (string, []byte, int64, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	for {
+		if o.readSeq == o.writeSeq && o.readPos >= o.writePos {
+			return "", nil, 0, io.EOF
+		}
+
+		end, err := o.readEnd()
+		if err != nil {
+			return "", nil, 0, err
+		}
+		topic, body, n, err := readOutboxRecord(o.readFile, o.readPos, end)
+		if err == nil {
+			return topic, body, n, nil
+		}
+		if err == io.EOF && o.readSeq != o.writeSeq {
+			// finished with this segment, move on to the next one
+			err = o.nextReadSegment()
+			if err != nil {
+				return "", nil, 0, err
+			}
+			continue
+		}
+
+		next := nextOutboxRecord(o.readFile, o.readPos+1, end)
+		outboxCorruptRecords.WithLabelValues(o.name).Inc()
+		o.logger.Error("skipping corrupt record", "segment", o.readSeq, "offset", o.readPos, "bytes", next-o.readPos, "err", err)
+		o.readPos = next
+		err = o.recount()
+		if err == nil {
+			err = o.persistMeta()
+		}
+		if err != nil {
+			return "", nil, 0, err
+		}
+	}
+}
+
+// readEnd returns the offset up to which the read segment holds
+// records: the write position if it is also the write segment, its
+// size otherwise
+func (o *Outbox) readEnd() (int64, error) {
+	if o.readSeq == o.writeSeq {
+		return o.writePos, nil
+	}
+	fi, err := o.readFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// deadLetter appends a record that cannot be delivered to the dead
+// letter file
+func (o *Outbox) deadLetter(topic string, body []byte, reason error) error {
+	event := json.RawMessage(body)
+	if !json.Valid(body) {
+		event, _ = json.Marshal(string(body))
+	}
+	line, err := json.Marshal(&outboxDeadLetter{
+		Time:  time.Now(),
+		Topic: topic,
+		Error: reason.Error(),
+		Event: event,
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(o.deadLetterPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	outboxDeadLetters.WithLabelValues(o.name).Inc()
+	return nil
+}
+
+// outboxDeadLetter is a line of the dead letter file. Event holds the
+// record body, as a JSON string if it is not JSON itself.
+type outboxDeadLetter struct {
+	Time  time.Time       `json:"time"`
+	Topic string          `json:"topic"`
+	Error string          `json:"error"`
+	Event json.RawMessage `json:"event"`
+}
+
+// advance discards the record at the head of the outbox
+func (o *Outbox) advance(n int64) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.readPos += n
+	atomic.AddInt64(&o.depth, -1)
+	atomic.AddInt64(&o.bytes, -n)
+
+	err := o.persistMeta()
+	if err != nil {
+		o.logger.Error("failed to persist read position", "err", err)
+	}
+}
+
+func (o *Outbox) nextReadSegment() error {
+	o.readFile.Close()
+	os.Remove(o.segmentPath(o.readSeq))
+
+	o.readSeq++
+	o.readPos = 0
+	f, err := os.Open(o.segmentPath(o.readSeq))
+	if err != nil {
+		return err
+	}
+	o.readFile = f
+	return o.persistMeta()
+}
+
+func (o *Outbox) rotate() error {
+	f, err := os.OpenFile(o.segmentPath(o.writeSeq+1), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	o.writeFile.Close()
+	o.writeFile = f
+	o.writeSeq++
+	o.writePos = 0
+	return nil
+}
+
+// load restores the read position from the meta file, truncates the
+// write segment after its last readable record, discarding a record
+// torn by a crash, and counts what is left to deliver
+func (o *Outbox) load() error {
+	buf, err := ioutil.ReadFile(o.metaPath())
+	if err == nil {
+		_, err = fmt.Sscanf(string(buf), "%d %d\n", &o.readSeq, &o.readPos)
+		if err != nil {
+			return fmt.Errorf("corrupt outbox meta file %s - %s", o.metaPath(), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	o.writeSeq = o.readSeq
+	for {
+		_, err := os.Stat(o.segmentPath(o.writeSeq + 1))
+		if err != nil {
+			break
+		}
+		o.writeSeq++
+	}
+
+	f, err := os.OpenFile(o.segmentPath(o.writeSeq), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	o.writeFile = f
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	pos := int64(0)
+	if o.writeSeq == o.readSeq {
+		pos = o.readPos
+	}
+	pos = scanOutboxSegment(f, pos, fi.Size(), func(n int64) {})
+	err = f.Truncate(pos)
+	if err == nil {
+		_, err = f.Seek(pos, 0)
+	}
+	if err != nil {
+		return err
+	}
+	o.writePos = pos
+
+	o.readFile, err = os.Open(o.segmentPath(o.readSeq))
+	if err != nil {
+		return err
+	}
+	return o.recount()
+}
+
+// recount sets the depth and size of the outbox from the readable
+// records between the read and the write position
+func (o *Outbox) recount() error {
+	var depth, bytes int64
+	count := func(n int64) {
+		depth++
+		bytes += n
+	}
+
+	for seq := o.readSeq; seq <= o.writeSeq; seq++ {
+		pos := int64(0)
+		if seq == o.readSeq {
+			pos = o.readPos
+		}
+
+		if seq == o.writeSeq {
+			scanOutboxSegment(o.writeFile, pos, o.writePos, count)
+			continue
+		}
+		f, err := os.Open(o.segmentPath(seq))
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err == nil {
+			scanOutboxSegment(f, pos, fi.Size(), count)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	atomic.StoreInt64(&o.depth, depth)
+	atomic.StoreInt64(&o.bytes, bytes)
+	return nil
+}
+
+func (o *Outbox) persistMeta() error {
+	tmp := o.metaPath() + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", o.readSeq, o.readPos)), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.metaPath())
+}
+
+func (o *Outbox) closeFiles() {
+	if o.readFile != nil {
+		o.readFile.Close()
+	}
+	if o.writeFile != nil {
+		o.writeFile.Close()
+	}
+}
+
+func (o *Outbox) segmentPath(seq int64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%s.outbox.%06d.dat", o.name, seq))
+}
+
+func (o *Outbox) deadLetterPath() string {
+	return filepath.Join(o.dir, fmt.Sprintf("%s.outbox.dead", o.name))
+}
+
+func (o *Outbox) metaPath() string {
+	return filepath.Join(o.dir, fmt.Sprintf("%s.outbox.meta", o.name))
+}
+
+// encodeOutboxRecord lays out a record as length, CRC32, 2 byte topic
+// length, topic and body
+func encodeOutboxRecord(topic string, body []byte) []byte {
+	rec := make([]byte, outboxHeaderLen+2+len(topic)+len(body))
+	binary.BigEndian.PutUint16(rec[outboxHeaderLen:], uint16(len(topic)))
+	copy(rec[outboxHeaderLen+2:], topic)
+	copy(rec[outboxHeaderLen+2+len(topic):], body)
+
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(rec)-outboxHeaderLen))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(rec[outboxHeaderLen:]))
+	return rec
+}
+
+// readOutboxRecord reads the record at pos, which must end by end,
+// returning io.EOF at end and an error for a torn or corrupt record
+func readOutboxRecord(f *os.File, pos int64, end int64) (string, []byte, int64, error) {
+	var hdr [outboxHeaderLen]byte
+
+	if pos >= end {
+		return "", nil, 0, io.EOF
+	}
+	if pos+outboxHeaderLen > end {
+		return "", nil, 0, io.ErrUnexpectedEOF
+	}
+	_, err := f.ReadAt(hdr[:], pos)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[0:4])
+	if size < 2 || size > outboxSegmentBytes {
+		return "", nil, 0, fmt.Errorf("invalid record size %d", size)
+	}
+	if pos+outboxHeaderLen+int64(size) > end {
+		return "", nil, 0, io.ErrUnexpectedEOF
+	}
+
+	rec := make([]byte, size)
+	_, err = f.ReadAt(rec, pos+outboxHeaderLen)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, 0, err
+	}
+	if crc32.ChecksumIEEE(rec) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return "", nil, 0, errors.New("record checksum mismatch")
+	}
+
+	topicLen := int(binary.BigEndian.Uint16(rec[0:2]))
+	if 2+topicLen > len(rec) {
+		return "", nil, 0, fmt.Errorf("invalid topic length %d", topicLen)
+	}
+	topic := string(rec[2 : 2+topicLen])
+	return topic, rec[2+topicLen:], int64(outboxHeaderLen + size), nil
+}
+
+// nextOutboxRecord returns the offset of the first readable record of
+// f between pos and end, or end if there is none. It resynchronizes
+// after a corrupt record one byte at a time, relying on the record
+// checksum to rule out false starts.
+func nextOutboxRecord(f *os.File, pos int64, end int64) int64 {
+	for ; pos < end; pos++ {
+		_, _, _, err := readOutboxRecord(f, pos, end)
+		if err == nil {
+			return pos
+		}
+	}
+	return end
+}
+
+// scanOutboxSegment calls fn with the size of each readable record of
+// f between pos and end, skipping corrupt ones, and returns the offset
+// just past the last
+func scanOutboxSegment(f *os.File, pos int64, end int64, fn func(n int64)) int64 {
+	last := pos
+	for pos < end {
+		_, _, n, err := readOutboxRecord(f, pos, end)
+		if err != nil {
+			pos = nextOutboxRecord(f, pos+1, end)
+			continue
+		}
+		pos += n
+		last = pos
+		fn(n)
+	}
+	return last
+}
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// collect returns an OutboxHandler that passes the bodies it delivers
+// to bodies, each once gate, if not nil, lets it
+func collect(bodies chan string, gate chan int) OutboxHandler {
+	return func(topic string, body []byte) error {
+		if gate != nil {
+			<-gate
+		}
+		bodies <- string(body)
+		return nil
+	}
+}
+
+// expectDelivered checks that the outbox delivers want, in order, and
+// nothing else
+func expectDelivered(t *testing.T, o *Outbox, bodies chan string, want ...string) {
+	for _, w := range want {
+		select {
+		case got := <-bodies:
+			if got != w {
+				t.Fatalf("delivered %q, want %q", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q not delivered", w)
+		}
+	}
+	if n := o.Flush(time.Now().Add(time.Second)); n != 0 {
+		t.Fatalf("%d records left", n)
+	}
+	select {
+	case got := <-bodies:
+		t.Fatalf("delivered %q too", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// corrupt flips a byte of the body of the record at pos in the
+// segment at path
+func corrupt(t *testing.T, path string, pos int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	off := pos + outboxHeaderLen + 4
+	_, err = f.ReadAt(b, off)
+	if err == nil {
+		b[0] ^= 0xFF
+		_, err = f.WriteAt(b, off)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A record found corrupt while running is skipped, not retried forever
+func TestOutboxSkipsCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bodies := make(chan string, 10)
+	gate := make(chan int)
+	o, err := NewOutbox("test", dir, 0, time.Second, collect(bodies, gate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	for _, body := range []string{"a", "b", "c"} {
+		err := o.Put("topic", []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "a" is being delivered
+	corrupt(t, o.segmentPath(0), int64(len(encodeOutboxRecord("topic", []byte("a")))))
+	close(gate)
+
+	expectDelivered(t, o, bodies, "a", "c")
+}
+
+// On open a record torn by a crash is discarded and a corrupt one
+// skipped, and the records around them are delivered
+func TestOutboxReopenCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := NewOutbox("test", dir, 0, time.Second, func(topic string, body []byte) error {
+		return errors.New("unavailable")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"a", "b", "c"} {
+		err := o.Put("topic", []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.Close()
+
+	path := o.segmentPath(0)
+	corrupt(t, path, int64(len(encodeOutboxRecord("topic", []byte("a")))))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := encodeOutboxRecord("topic", []byte("torn"))
+	_, err = f.Write(torn[:len(torn)-2])
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := make(chan string, 10)
+	o, err = NewOutbox("test", dir, 0, time.Second, collect(bodies, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	err = o.Put("topic", []byte("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectDelivered(t, o, bodies, "a", "c", "d")
+}
+
+// A record the handler rejects for good goes to the dead letter file
+// instead of blocking the records behind it
+func TestOutboxDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bodies := make(chan string, 10)
+	deliver := collect(bodies, nil)
+	o, err := NewOutbox("test", dir, 0, time.Second, func(topic string, body []byte) error {
+		if string(body) == `{"bad":true}` {
+			return ErrPermanent{Err: errors.New("rejected")}
+		}
+		return deliver(topic, body)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	for _, body := range []string{`"a"`, `{"bad":true}`, `"c"`} {
+		err := o.Put("topic", []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectDelivered(t, o, bodies, `"a"`, `"c"`)
+
+	f, err := os.Open(o.deadLetterPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var dead []outboxDeadLetter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var d outboxDeadLetter
+		err := json.Unmarshal(scanner.Bytes(), &d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dead = append(dead, d)
+	}
+	if len(dead) != 1 || dead[0].Topic != "topic" || dead[0].Error != "rejected" || string(dead[0].Event) != `{"bad":true}` {
+		t.Fatalf("dead letters %+v", dead)
+	}
+}
@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// LogPanic counts the panic r recovered in where and logs it with the
+// stack of the panicking goroutine and the key/value pairs kv. Call it
+// from the deferred function that recovered r.
+func LogPanic(logger *Logger, where string, r interface{}, kv ...interface{}) {
+	panics.WithLabelValues(where).Inc()
+	kv = append(kv, "where", where, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+	logger.Error("recovered from panic", kv...)
+}
+
+// recoverPanic, deferred first thing by each goroutine of a connection,
+// confines a panic to the connection: it is logged with the device ID
+// and the connection closed, while the other connections keep running.
+// cleanup, if not nil, runs what the goroutine would have run on its
+// way out.
+func (c *Conn) recoverPanic(where string, cleanup func()) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	LogPanic(DefaultLogger(), where, r, "rsu", c.ID(), "addr", c.remoteAddr)
+	c.setCloseReason(fmt.Sprintf("panic in %s - %v", where, r))
+	c.close()
+	if cleanup != nil {
+		cleanup()
+	}
+}
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EventSink delivers events published by a protocol instance, such as
+// decoded OBU transactions, to downstream consumers
+type EventSink interface {
+	// Publish delivers the JSON encoded event body under topic
+	Publish(topic string, body []byte) error
+	Close() error
+}
+
+// sinkRecord is the envelope used by sinks that have no notion of
+// topics of their own
+type sinkRecord struct {
+	Topic string          `json:"topic"`
+	Time  time.Time       `json:"time"`
+	Event json.RawMessage `json:"event"`
+}
+
+func newSinkRecord(topic string, body []byte) ([]byte, error) {
+	return json.Marshal(&sinkRecord{
+		Topic: topic,
+		Time:  time.Now(),
+		Event: json.RawMessage(body),
+	})
+}
+
+// NewEventSink builds the sinks named in opts.EventSinks, a comma
+// separated list of kafka, file, webhook and nop. Events are published
+// to every sink in turn. Each sink but nop is wrapped in a DurableSink
+// of its own, so that a sink that is down or rejects an event holds up
+// none of the others, and retries go to that sink alone.
+func NewEventSink(opts *AgentdOptions) (EventSink, error) {
+	return reloadEventSink(opts, nil)
+}
+
+// reloadEventSink is NewEventSink for an agentd whose sinks are old.
+// The DurableSinks of old are kept for the sinks of the same name, with
+// the new sinks swapped in, so that the events queued for them are not
+// lost; the rest of old is closed. old is left alone on error.
+func reloadEventSink(opts *AgentdOptions, old EventSink) (EventSink, error) {
+	var names []string
+	sinks := make(map[string]EventSink)
+	for _, name := range strings.Split(opts.EventSinks, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := sinks[name]; ok || name == "" {
+			continue
+		}
+		sink, err := newSink(name, opts)
+		if err != nil {
+			for _, s := range sinks {
+				s.Close()
+			}
+			return nil, err
+		}
+		names = append(names, name)
+		sinks[name] = sink
+	}
+
+	kept := make(map[string]*DurableSink)
+	for _, s := range flattenSinks(old) {
+		if d, ok := s.(*DurableSink); ok {
+			kept[d.Name()] = d
+		}
+	}
+
+	durable := make(map[string]*DurableSink)
+	for _, name := range names {
+		if _, ok := kept[name]; ok || name == "nop" {
+			continue
+		}
+		d, err := NewDurableSink(name, sinks[name], opts)
+		if err != nil {
+			for _, d := range durable {
+				d.Close()
+			}
+			for n, s := range sinks {
+				if _, ok := durable[n]; !ok {
+					s.Close()
+				}
+			}
+			return nil, fmt.Errorf("failed to open %s event sink outbox in %s - %s", name, opts.DataPath, err)
+		}
+		durable[name] = d
+	}
+
+	var multi MultiSink
+	for _, name := range names {
+		if d, ok := kept[name]; ok {
+			d.Swap(sinks[name]).Close()
+			durable[name] = d
+		}
+		if d, ok := durable[name]; ok {
+			multi = append(multi, d)
+		} else {
+			multi = append(multi, sinks[name])
+		}
+	}
+	for _, s := range flattenSinks(old) {
+		if d, ok := s.(*DurableSink); !ok || durable[d.Name()] != d {
+			s.Close()
+		}
+	}
+
+	switch len(multi) {
+	case 0:
+		return NopSink{}, nil
+	case 1:
+		return multi[0], nil
+	}
+	return multi, nil
+}
+
+// newSink builds the sink called name
+func newSink(name string, opts *AgentdOptions) (EventSink, error) {
+	switch name {
+	case "kafka":
+		return NewKafkaSink(strings.Split(opts.KafkaBrokers, ","))
+	case "file":
+		return NewFileSink(opts.EventFile)
+	case "webhook":
+		return NewWebhookSink(opts.WebhookURL, opts.WebhookTimeout)
+	case "nop":
+		return NopSink{}, nil
+	}
+	return nil, fmt.Errorf("unknown event sink %q", name)
+}
+
+// flattenSinks returns the sinks making up sink
+func flattenSinks(sink EventSink) []EventSink {
+	if m, ok := sink.(MultiSink); ok {
+		return m
+	}
+	if sink == nil {
+		return nil
+	}
+	return []EventSink{sink}
+}
+
+// sinkFlusher is implemented by sinks that queue events, to wait until
+// deadline for them to be delivered, returning the number left
+type sinkFlusher interface {
+	Flush(deadline time.Time) int64
+}
+
+// MultiSink publishes every event to all of its sinks
+type MultiSink []EventSink
+
+// Publish delivers the event to each sink, returning the first error
+// encountered after trying them all
+func (m MultiSink) Publish(topic string, body []byte) error {
+	var firstErr error
+	for _, s := range m {
+		err := s.Publish(topic, body)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Flush waits until deadline for the events queued by the sinks to be
+// delivered and returns the number of events left
+func (m MultiSink) Flush(deadline time.Time) int64 {
+	var n int64
+	for _, s := range m {
+		if f, ok := s.(sinkFlusher); ok {
+			n += f.Flush(deadline)
+		}
+	}
+	return n
+}
+
+func (m MultiSink) Close() error {
+	var firstErr error
+	for _, s := range m {
+		err := s.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// NopSink discards every event
+type NopSink struct{}
+
+func (NopSink) Publish(topic string, body []byte) error {
+	return nil
+}
+
+func (NopSink) Close() error {
+	return nil
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// DurableSink queues events in an on-disk Outbox and delivers them to
+// the wrapped sink in the background, so that events published while
+// the sink is unreachable are delivered once it comes back. Events the
+// sink rejects with an ErrPermanent go to the outbox's dead letter
+// file.
+type DurableSink struct {
+	sync.RWMutex
+	name   string
+	sink   EventSink
+	outbox *Outbox
+}
+
+// NewDurableSink wraps sink, called name, in the outbox sink-<name>
+// under opts.DataPath
+func NewDurableSink(name string, sink EventSink, opts *AgentdOptions) (*DurableSink, error) {
+	s := &DurableSink{
+		name: name,
+		sink: sink,
+	}
+	outbox, err := NewOutbox("sink-"+name, opts.DataPath, opts.OutboxMaxBytes, opts.OutboxMaxBackoff, s.deliver)
+	if err != nil {
+		return nil, err
+	}
+	s.outbox = outbox
+	return s, nil
+}
+
+// Name returns the name of the wrapped sink
+func (s *DurableSink) Name() string {
+	return s.name
+}
+
+func (s *DurableSink) deliver(topic string, body []byte) error {
+	s.RLock()
+	defer s.RUnlock()
+	return s.sink.Publish(topic, body)
+}
+
+// Swap replaces the wrapped sink, returning the previous one once any
+// delivery to it has finished. Events still queued go to the new sink.
+func (s *DurableSink) Swap(sink EventSink) EventSink {
+	s.Lock()
+	defer s.Unlock()
+	old := s.sink
+	s.sink = sink
+	return old
+}
+
+// Publish returns once the event is safely on disk
+func (s *DurableSink) Publish(topic string, body []byte) error {
+	return s.outbox.Put(topic, body)
+}
+
+// Depth returns the number of events awaiting delivery
+func (s *DurableSink) Depth() int64 {
+	return s.outbox.Depth()
+}
+
+// Flush waits until deadline for the queued events to be delivered and
+// returns the number of events left
+func (s *DurableSink) Flush(deadline time.Time) int64 {
+	return s.outbox.Flush(deadline)
+}
+
+func (s *DurableSink) Close() error {
+	s.outbox.Close()
+
+	s.RLock()
+	defer s.RUnlock()
+	return s.sink.Close()
+}
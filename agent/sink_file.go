@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// FileSink appends each event to a file as one JSON line
+type FileSink struct {
+	sync.Mutex
+	f *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	if path == "" {
+		return nil, errors.New("file sink requires a path")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f}, nil
+}
+
+func (s *FileSink) Publish(topic string, body []byte) error {
+	line, err := newSinkRecord(topic, body)
+	if err != nil {
+		return ErrPermanent{err}
+	}
+	line = append(line, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+
+	_, err = s.f.Write(line)
+	if err != nil {
+		sinkPublishFailures.WithLabelValues("file").Inc()
+	}
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.f.Close()
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"fmt"
+	kafka "github.com/Shopify/sarama"
+	"sync"
+)
+
+// KafkaSink publishes each event to the Kafka topic of the same name.
+// Publish returns once the broker has acknowledged the event, so that
+// a DurableSink only drops events Kafka has accepted. The sink connects
+// on the first Publish, and again after losing the brokers, so that
+// agentd starts and queues events while Kafka is down.
+type KafkaSink struct {
+	sync.Mutex
+	brokers  []string
+	client   *kafka.Client
+	producer *kafka.SimpleProducer
+}
+
+func NewKafkaSink(brokers []string) (*KafkaSink, error) {
+	return &KafkaSink{
+		brokers: brokers,
+	}, nil
+}
+
+// connect returns the producer, connecting to the brokers first if
+// need be
+func (s *KafkaSink) connect() (*kafka.SimpleProducer, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.producer != nil {
+		return s.producer, nil
+	}
+
+	client, err := kafka.NewClient("agentd", s.brokers, kafka.NewClientConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kafka - %s", err)
+	}
+	producer, err := kafka.NewSimpleProducer(client, nil)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to create Kafka producer - %s", err)
+	}
+
+	s.client = client
+	s.producer = producer
+	return producer, nil
+}
+
+func (s *KafkaSink) Publish(topic string, body []byte) error {
+	producer, err := s.connect()
+	if err == nil {
+		err = producer.SendMessage(topic, nil, kafka.ByteEncoder(body))
+	}
+	if err == nil {
+		return nil
+	}
+
+	sinkPublishFailures.WithLabelValues("kafka").Inc()
+	if kafkaPermanent(err) {
+		return ErrPermanent{err}
+	}
+	if _, ok := err.(kafka.KError); !ok {
+		// the client may have run out of brokers; start afresh
+		s.Close()
+	}
+	return err
+}
+
+// kafkaPermanent reports whether Kafka refused an event for good: the
+// event is too large or malformed, or the topic is still unknown after
+// the client refreshed its metadata
+func kafkaPermanent(err error) bool {
+	switch err {
+	case kafka.ErrInvalidMessage, kafka.ErrInvalidMessageSize, kafka.ErrMessageSizeTooLarge, kafka.ErrUnknownTopicOrPartition:
+		return true
+	}
+	return false
+}
+
+func (s *KafkaSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.producer == nil {
+		return nil
+	}
+	s.producer.Close()
+	err := s.client.Close()
+	s.producer = nil
+	s.client = nil
+	return err
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SinkEvent is an event published to a MemSink
+type SinkEvent struct {
+	Topic string
+	Time  time.Time
+	Body  []byte
+}
+
+// MemSink keeps published events in memory, for tests that should not
+// need Kafka. SetError makes Publish fail, as during a broker outage.
+type MemSink struct {
+	sync.Mutex
+	events []SinkEvent
+	err    error
+	// closed and replaced on every publish to wake up waiters
+	notifyChan chan int
+}
+
+func NewMemSink() *MemSink {
+	return &MemSink{
+		notifyChan: make(chan int),
+	}
+}
+
+// SetError makes Publish fail with err until it is called with nil
+func (s *MemSink) SetError(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.err = err
+}
+
+func (s *MemSink) Publish(topic string, body []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		sinkPublishFailures.WithLabelValues("memory").Inc()
+		return s.err
+	}
+	s.events = append(s.events, SinkEvent{
+		Topic: topic,
+		Time:  time.Now(),
+		Body:  append([]byte(nil), body...),
+	})
+	close(s.notifyChan)
+	s.notifyChan = make(chan int)
+	return nil
+}
+
+func (s *MemSink) Close() error {
+	return nil
+}
+
+// Events returns the events published under topic, or every event if
+// topic is empty, oldest first
+func (s *MemSink) Events(topic string) []SinkEvent {
+	s.Lock()
+	defer s.Unlock()
+
+	var events []SinkEvent
+	for _, e := range s.events {
+		if topic == "" || e.Topic == topic {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// WaitFor waits up to timeout for n events to have been published under
+// topic and returns them
+func (s *MemSink) WaitFor(topic string, n int, timeout time.Duration) ([]SinkEvent, error) {
+	deadline := time.After(timeout)
+	for {
+		s.Lock()
+		notifyChan := s.notifyChan
+		s.Unlock()
+
+		events := s.Events(topic)
+		if len(events) >= n {
+			return events, nil
+		}
+
+		select {
+		case <-notifyChan:
+		case <-deadline:
+			return events, fmt.Errorf("%d of %d %s events published in %s", len(events), n, topic, timeout)
+		}
+	}
+}
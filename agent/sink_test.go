@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// A sink that is down neither holds up the other sinks nor makes them
+// receive an event twice
+func TestSinkOutage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := NewAgentdOptions()
+	opts.DataPath = dir
+	opts.OutboxMaxBackoff = outboxMinBackoff
+
+	down := NewMemSink()
+	down.SetError(errors.New("unavailable"))
+	up := NewMemSink()
+	var sinks MultiSink
+	for name, s := range map[string]EventSink{"down": down, "up": up} {
+		d, err := NewDurableSink(name, s, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sinks = append(sinks, d)
+	}
+	defer sinks.Close()
+
+	for _, body := range []string{`"a"`, `"b"`, `"c"`} {
+		err := sinks.Publish("topic", []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = up.WaitFor("topic", 3, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// several retries of the sink that is down
+	time.Sleep(5 * outboxMinBackoff)
+
+	down.SetError(nil)
+	_, err = down.WaitFor("topic", 3, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sinks.Flush(time.Now().Add(time.Second)); n != 0 {
+		t.Fatalf("%d events left", n)
+	}
+	if n := len(up.Events("topic")); n != 3 {
+		t.Fatalf("%d events published to the sink that was up, want 3", n)
+	}
+	if n := len(down.Events("topic")); n != 3 {
+		t.Fatalf("%d events published to the sink that was down, want 3", n)
+	}
+}
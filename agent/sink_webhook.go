@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WebhookSink POSTs each event to an HTTP endpoint
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookSink(url string, timeout time.Duration) (*WebhookSink, error) {
+	if url == "" {
+		return nil, errors.New("webhook sink requires a URL")
+	}
+	return &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (s *WebhookSink) Publish(topic string, body []byte) error {
+	record, err := newSinkRecord(topic, body)
+	if err != nil {
+		return ErrPermanent{err}
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(record))
+	if err != nil {
+		sinkPublishFailures.WithLabelValues("webhook").Inc()
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		sinkPublishFailures.WithLabelValues("webhook").Inc()
+		err = fmt.Errorf("webhook %s returned %s", s.url, resp.Status)
+		if permanentStatus(resp.StatusCode) {
+			return ErrPermanent{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// permanentStatus reports whether a webhook response with status code
+// rejects the event itself, so that sending it again is pointless
+func permanentStatus(code int) bool {
+	if code == http.StatusRequestTimeout || code == http.StatusTooManyRequests {
+		return false
+	}
+	return code >= 400 && code <= 499
+}
+
+func (s *WebhookSink) Close() error {
+	return nil
+}
@@ -8,25 +8,28 @@ import (
 
 func tcpServer(a *AgentD) {
 	listener := a.tcpListener
-	a.logf("TCP: listening on %s", listener.Addr())
+	a.logger.Info("TCP: listening", "addr", listener.Addr())
 
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				a.logf("NOTICE: temporary Accept() failure - %s", err)
+				a.logger.Warn("TCP: temporary Accept() failure", "err", err)
 				runtime.Gosched()
 				continue
 			}
 			// theres no direct way to detect this error because it is not exposed
 			if !strings.Contains(err.Error(), "use of closed network connection") {
-				a.logf("ERROR: listener.Accept() - %s", err)
+				a.logger.Error("TCP: listener.Accept() failed", "err", err)
 			}
 			break
 		}
-		a.logf("TCP: new client(%s)", clientConn.RemoteAddr())
+		a.logger.Debug("TCP: new client", "addr", clientConn.RemoteAddr())
+		// counted here rather than in Start so that Exit, once this loop
+		// has returned, waits for every connection it accepted
+		a.clientsWaitGroup.Add(1)
 		go NewConn(a, clientConn).Start()
 	}
 
-	a.logf("TCP: closing %s", listener.Addr())
+	a.logger.Info("TCP: closing", "addr", listener.Addr())
 }
@@ -3,24 +3,268 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/BurntSushi/toml"
 	"github.com/aiyi/agent/agent"
 	"github.com/aiyi/agent/rsu"
 	"github.com/aiyi/agent/util"
 	"github.com/mreiferson/go-options"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// envPrefix is prepended to the upper-cased, underscored flag name to
+// form the environment variable overriding an option, e.g.
+// AGENTD_KAFKA_BROKERS for --kafka-brokers
+const envPrefix = "AGENTD_"
+
 var (
 	flagset = flag.NewFlagSet("agentd", flag.ExitOnError)
 
 	showVersion = flagset.Bool("version", false, "print version string")
+	config      = flagset.String("config", "", "path to config file")
+
 	tcpAddress  = flagset.String("tcp-address", "0.0.0.0:3002", "<addr>:<port> to listen on for TCP clients")
+	httpAddress = flagset.String("http-address", "0.0.0.0:8080", "<addr>:<port> to listen on for HTTP clients")
+	swaggerPath = flagset.String("swagger-path", "/root/go/src/github.com/wordnik/swagger-ui/dist", "path to the swagger-ui dist directory served under /apidocs/")
+
+	heartbeatInterval      = flagset.Duration("heartbeat-interval", 5*time.Second, "interval between heartbeats sent to each RSU")
+	heartbeatMissThreshold = flagset.Int("heartbeat-miss-threshold", 2, "number of heartbeats in a row an RSU may leave unanswered before it is disconnected; an RSU that sends nothing at all is disconnected after (threshold+2) heartbeat intervals")
+	logLevel               = flagset.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat              = flagset.String("log-format", "logfmt", "log output format: logfmt or json")
+
+	commandTimeout      = flagset.Duration("command-timeout", 5*time.Second, "duration to wait for an RSU to answer a command")
+	typeCommandTimeouts = util.StringArray{}
+
+	eventSinks     = flagset.String("event-sink", "kafka", "comma separated event sinks to publish OBU events to: kafka, file, webhook, nop")
+	kafkaBrokers   = flagset.String("kafka-brokers", "localhost:9092", "comma separated <addr>:<port> of Kafka brokers for the kafka sink")
+	eventFile      = flagset.String("event-file", "", "path of the JSON lines file written by the file sink")
+	webhookURL     = flagset.String("webhook-url", "", "URL the webhook sink POSTs events to")
+	webhookTimeout = flagset.Duration("webhook-timeout", 5*time.Second, "timeout for webhook sink requests")
+	lifecycleTopic = flagset.String("lifecycle-topic", "lifecycle_event", "topic to publish RSU connect, disconnect, missed heartbeat and protocol error events to (empty to disable)")
+
+	store        = flagset.String("store", "mongo", "where to store OBU events, tags and targets: mongo or file (embedded, under --data-path)")
+	mongoAddress = flagset.String("mongo-address", "localhost", "<addr>[:<port>] of the MongoDB server for the mongo store")
+	eventTTL     = flagset.Duration("event-ttl", 7*24*time.Hour, "how long to keep stored OBU events")
+
+	dataPath         = flagset.String("data-path", "", "path to store undelivered events in")
+	outboxMaxBytes   = flagset.Int64("outbox-max-bytes", 100*1024*1024, "maximum size in bytes of undelivered events kept on disk per outbox")
+	outboxMaxBackoff = flagset.Duration("outbox-max-backoff", 30*time.Second, "maximum delay between attempts to deliver a queued event")
+
+	frameErrorPolicy = flagset.String("frame-error-policy", "drop", "what to do with corrupt RSU frames: drop (resynchronize), close (disconnect) or log (keep the frame)")
+
+	capturePath     = flagset.String("capture-path", "", "directory to record the raw frames of each RSU in, one file per remote host (empty to disable)")
+	captureMaxBytes = flagset.Int64("capture-max-bytes", 10*1024*1024, "size in bytes at which a capture file is rotated (0 to never rotate)")
+	captureMaxFiles = flagset.Int("capture-max-files", 5, "number of rotated capture files kept per remote host")
+
+	replayPublish = flagset.Bool("replay-publish", false, "agentd replay only: publish and store the replayed events with the configured event sinks and store instead of discarding them")
+
+	shutdownTimeout = flagset.Duration("shutdown-timeout", 10*time.Second, "how long to wait on shutdown for RSU sessions to close and received events to be delivered")
 )
 
+func init() {
+	flagset.Var(&typeCommandTimeouts, "type-command-timeout", "<msgType>=<duration> command timeout override for one request type, e.g. 0xD067=10s (may be given multiple times)")
+}
+
+// commandLineOnly reports whether the flag called name can only be
+// given on the command line, not in the config file or environment
+func commandLineOnly(name string) bool {
+	return name == "config" || name == "version" || name == "replay-publish"
+}
+
+// loadConfig reads the TOML config file at path. Keys are flag names
+// with '-' replaced by '_'; a key matching no flag is an error.
+func loadConfig(path string) (map[string]interface{}, error) {
+	cfg := make(map[string]interface{})
+	if path == "" {
+		return cfg, nil
+	}
+
+	_, err := toml.DecodeFile(path, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file %s - %s", path, err)
+	}
+
+	for key := range cfg {
+		name := strings.Replace(key, "_", "-", -1)
+		if commandLineOnly(name) || flagset.Lookup(name) == nil {
+			return nil, agent.ErrOption{Key: key, Reason: "unknown key in config file " + path}
+		}
+	}
+	return cfg, nil
+}
+
+// applyEnv overlays AGENTD_* environment variables on cfg so that they
+// take precedence over the config file but not over the command line
+func applyEnv(cfg map[string]interface{}) {
+	flagset.VisitAll(func(f *flag.Flag) {
+		if commandLineOnly(f.Name) {
+			return
+		}
+		key := strings.Replace(f.Name, "-", "_", -1)
+		val, ok := os.LookupEnv(envPrefix + strings.ToUpper(key))
+		if ok {
+			cfg[key] = val
+		}
+	})
+}
+
+// checkConfig parses each value in cfg as its flag would on the command
+// line, since options.Resolve exits on a value it cannot convert
+func checkConfig(cfg map[string]interface{}) error {
+	scratch := flag.NewFlagSet("agentd", flag.ContinueOnError)
+	flagset.VisitAll(func(f *flag.Flag) {
+		value := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+		scratch.Var(value, f.Name, f.Usage)
+	})
+
+	for key, v := range cfg {
+		name := strings.Replace(key, "_", "-", -1)
+		vals, ok := v.([]interface{})
+		if !ok {
+			vals = []interface{}{v}
+		}
+		for _, val := range vals {
+			s := configString(name, val)
+			err := scratch.Set(name, s)
+			if err != nil {
+				return agent.ErrOption{Key: key, Reason: fmt.Sprintf("cannot use %q - %s", s, err)}
+			}
+		}
+	}
+	return nil
+}
+
+// configString returns v, the value of the flag called name in the
+// config file or the environment, as it would be given on the command
+// line
+func configString(name string, v interface{}) string {
+	n, ok := v.(int64)
+	if ok {
+		_, ok = flagset.Lookup(name).Value.(flag.Getter).Get().(time.Duration)
+		if ok {
+			// options.Resolve takes integer durations in milliseconds
+			return (time.Duration(n) * time.Millisecond).String()
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// loadOptions resolves the options from, in order of precedence, the
+// command line, the environment, the config file and the defaults
+func loadOptions() (*agent.AgentdOptions, error) {
+	cfg, err := loadConfig(*config)
+	if err != nil {
+		return nil, err
+	}
+	applyEnv(cfg)
+	err = checkConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := agent.NewAgentdOptions()
+	options.Resolve(opts, flagset, cfg)
+
+	err = opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// checkProtocolOptions validates the RSU specific options
+func checkProtocolOptions(opts *agent.AgentdOptions) error {
+	_, err := rsu.ParseFrameErrorPolicy(opts.FrameErrorPolicy)
+	if err != nil {
+		return agent.ErrOption{Key: "frame-error-policy", Reason: err.Error()}
+	}
+	_, err = rsu.ParseCommandTimeouts(opts.TypeCommandTimeouts)
+	if err != nil {
+		return agent.ErrOption{Key: "type-command-timeout", Reason: err.Error()}
+	}
+	return nil
+}
+
+// applyProtocolOptions hands the RSU specific options, checked by
+// checkProtocolOptions, to the rsu package. When reloading, old holds
+// the options in force and only those that differ from it are applied,
+// so that a heartbeat interval set through the REST API survives
+// reloads that leave the configured one alone.
+func applyProtocolOptions(a *agent.AgentD, old *agent.AgentdOptions, opts *agent.AgentdOptions) {
+	if old == nil || old.FrameErrorPolicy != opts.FrameErrorPolicy {
+		rsu.SetFrameErrorPolicy(opts.FrameErrorPolicy)
+	}
+	if old == nil || !reflect.DeepEqual(old.TypeCommandTimeouts, opts.TypeCommandTimeouts) {
+		rsu.SetCommandTimeouts(opts.TypeCommandTimeouts)
+	}
+	if old == nil || old.HeartbeatInterval != opts.HeartbeatInterval {
+		atomic.StoreUint32(&rsu.HBInterval, uint32(opts.HeartbeatInterval/time.Second))
+		if a != nil {
+			a.ResetHeartbeats()
+		}
+	}
+}
+
+var reloadMtx sync.Mutex
+
+// reload rereads the configuration and applies it to the running
+// agentd, returning the changed options that need a restart. Nothing
+// is applied if the new configuration is invalid or agentd fails to
+// apply it.
+func reload(a *agent.AgentD, store rsu.Store) ([]string, error) {
+	reloadMtx.Lock()
+	defer reloadMtx.Unlock()
+
+	opts, err := loadOptions()
+	if err != nil {
+		return nil, err
+	}
+	err = checkProtocolOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	old := a.Options()
+	restart, err := a.Reload(opts)
+	if err != nil {
+		return restart, err
+	}
+	applyProtocolOptions(a, old, opts)
+
+	err = store.Reload()
+	if err != nil {
+		return restart, fmt.Errorf("failed to reload tags and targets - %s", err)
+	}
+
+	logger.Info("configuration reloaded")
+	if len(restart) > 0 {
+		logger.Warn("restart required to apply changed options", "options", strings.Join(restart, ","))
+	}
+	return restart, nil
+}
+
+var logger = agent.DefaultLogger()
+
+// fatal logs msg at error level and exits
+func fatal(msg string, kv ...interface{}) {
+	logger.Error(msg, kv...)
+	os.Exit(1)
+}
+
 func main() {
-	flagset.Parse(os.Args[1:])
+	// agentd replay [flags] <capture file>
+	replayMode := len(os.Args) > 1 && os.Args[1] == "replay"
+	if replayMode {
+		flagset.Parse(os.Args[2:])
+	} else {
+		flagset.Parse(os.Args[1:])
+	}
 
 	if *showVersion {
 		fmt.Println(util.Version("agentd"))
@@ -28,17 +272,74 @@ func main() {
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
-	opts := agent.NewAgentdOptions()
-	options.Resolve(opts, flagset, nil)
+	opts, err := loadOptions()
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+	agent.SetLogOptions(opts)
+	err = checkProtocolOptions(opts)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+	applyProtocolOptions(nil, nil, opts)
 
-	a := agent.NewAgentD(opts, &rsu.RsuProtocol{})
-	r := rsu.NewRestServer(a)
-	
-	r.Main()
-	a.Main()
+	if replayMode {
+		if flagset.NArg() != 1 {
+			fatal("usage: agentd replay [flags] <capture file>")
+		}
+		err = replay(opts, flagset.Arg(0), *replayPublish)
+		if err != nil {
+			fatal("replay failed", "err", err)
+		}
+		return
+	}
+
+	store, err := rsu.NewStore(opts)
+	if err != nil {
+		fatal("failed to open store", "store", opts.Store, "err", err)
+	}
+
+	proto, err := rsu.NewRsuProtocol(opts, store)
+	if err != nil {
+		fatal("failed to start RSU protocol", "err", err)
+	}
+
+	a, err := agent.NewAgentD(opts, proto)
+	if err != nil {
+		fatal("failed to start agentd", "err", err)
+	}
+	r := rsu.NewRestServer(a, store, proto.Registry(), func() ([]string, error) {
+		return reload(a, store)
+	})
+
+	err = r.Main()
+	if err != nil {
+		fatal("failed to start REST server", "err", err)
+	}
+	err = a.Main()
+	if err != nil {
+		fatal("failed to start agentd", "err", err)
+	}
+
+	for {
+		select {
+		case <-hupChan:
+			_, err := reload(a, store)
+			if err != nil {
+				logger.Error("failed to reload configuration", "err", err)
+			}
+			continue
+		case <-signalChan:
+		}
+		break
+	}
 
-	<-signalChan
+	// the REST API and the store stay up while agentd drains
 	a.Exit()
+	proto.Exit()
 	r.Exit()
+	store.Close()
 }
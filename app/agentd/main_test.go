@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aiyi/agent/agent"
+	"github.com/aiyi/agent/harness"
+	"github.com/aiyi/agent/rsusim"
+)
+
+// A reload with a value that cannot be converted, from the config file
+// or the environment, fails and leaves agentd running as it was
+func TestReloadBadValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agentd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, err := harness.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	path := filepath.Join(dir, "agentd.cfg")
+	*config = path
+	defer func() { *config = "" }()
+
+	for _, c := range []struct {
+		cfg string
+		env string
+		key string
+	}{
+		{cfg: `heartbeat_interval = "abc"`, key: "heartbeat_interval"},
+		{cfg: `heartbeat_miss_threshold = "two"`, key: "heartbeat_miss_threshold"},
+		{env: "1x", key: "outbox_max_bytes"},
+	} {
+		err := ioutil.WriteFile(path, []byte(c.cfg+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.env != "" {
+			os.Setenv("AGENTD_OUTBOX_MAX_BYTES", c.env)
+		}
+		_, err = reload(h.AgentD, h.Store)
+		os.Unsetenv("AGENTD_OUTBOX_MAX_BYTES")
+
+		e, ok := err.(agent.ErrOption)
+		if !ok || e.Key != c.key {
+			t.Fatalf("reload with %q %q = %v, want invalid option %s", c.cfg, c.env, err, c.key)
+		}
+	}
+
+	if h.AgentD.Options().HeartbeatInterval != harness.NewOptions().HeartbeatInterval {
+		t.Fatalf("heartbeat interval %s after failed reloads", h.AgentD.Options().HeartbeatInterval)
+	}
+	_, err = h.AddRSU(rsusim.NewConfig(1000, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.WaitClient("1000-1", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aiyi/agent/agent"
+	"github.com/aiyi/agent/rsu"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// replay feeds the frames received in the capture file at path through
+// a fresh RSU protocol instance, handling OBU events as a live
+// connection would. Frames sent to the RSU are only counted.
+//
+// Unless publish is set, events are discarded and stored in memory
+// only, with the outboxes in a temporary directory, so that replaying
+// a field capture on a station host leaves the running agentd, Kafka
+// and MongoDB alone. With publish, events go to the configured sinks
+// and store; the outboxes are kept apart from agentd's under
+// <data-path>/replay, but a file store is shared, so stop agentd first.
+func replay(opts *agent.AgentdOptions, path string, publish bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var in []io.Reader
+	var records, sent int
+	err = agent.ReadCapture(f, func(rec agent.CaptureRecord) error {
+		records++
+		if rec.Dir == agent.CaptureOut {
+			sent++
+			return nil
+		}
+		in = append(in, bytes.NewReader(rec.Data))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read capture %s - %s", path, err)
+	}
+
+	var store rsu.Store
+	replayOpts := *opts
+	if publish {
+		store, err = rsu.NewStore(opts)
+		if err != nil {
+			return fmt.Errorf("failed to open store - %s", err)
+		}
+		replayOpts.DataPath = filepath.Join(opts.DataPath, "replay")
+	} else {
+		store = rsu.NewMemStore()
+		dir, err := ioutil.TempDir("", "agentd-replay")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		replayOpts.DataPath = dir
+	}
+	defer store.Close()
+
+	proto, err := rsu.NewRsuProtocol(&replayOpts, store)
+	if err != nil {
+		return fmt.Errorf("failed to start RSU protocol - %s", err)
+	}
+	var a *agent.AgentD
+	if publish {
+		a, err = agent.NewAgentD(&replayOpts, proto)
+	} else {
+		a, err = agent.NewAgentDWithSink(&replayOpts, proto, agent.NopSink{})
+	}
+	if err != nil {
+		proto.Exit()
+		return err
+	}
+	inst := proto.NewProtoInstance(a)
+
+	// the frames of one record may continue in the next, so the
+	// decoder reads them as the single stream they arrived as
+	r := io.MultiReader(in...)
+	var frames, handled, errors int
+	for {
+		frameType, msg, err := inst.DecodeMessage(r)
+		if err == rsu.ReadPacketError {
+			break
+		}
+		if err != nil {
+			errors++
+			logger.Warn("failed to decode frame", "err", err)
+			continue
+		}
+
+		frames++
+		logger.Info("frame decoded", "frame", msg)
+		if frameType == agent.FrameTypeMessage {
+			inst.HandleMessage(msg)
+			handled++
+		}
+	}
+
+	a.Exit()
+	proto.Exit()
+
+	logger.Info("replay finished", "capture", path, "records", records, "sent", sent,
+		"frames", frames, "handled", handled, "errors", errors, "published", publish)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/aiyi/agent/agent"
+	"github.com/aiyi/agent/rsu"
+	"github.com/aiyi/agent/rsusim"
+	"github.com/aiyi/agent/util"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	flagset = flag.NewFlagSet("rsusim", flag.ExitOnError)
+
+	showVersion = flagset.Bool("version", false, "print version string")
+
+	address   = flagset.String("address", "127.0.0.1:3002", "<addr>:<port> of agentd to connect to")
+	count     = flagset.Int("count", 1, "number of RSUs to simulate, on consecutive roadways")
+	reconnect = flagset.Duration("reconnect", 5*time.Second, "delay before an RSU that lost its connection dials again (0 to give up)")
+	logLevel  = flagset.String("log-level", "info", "log level: debug, info, warn or error")
+
+	station      = flagset.Uint("station", 1000, "station of the first RSU")
+	roadway      = flagset.Uint("roadway", 1, "roadway of the first RSU")
+	channel      = flagset.Uint("channel", 1, "channel reported until agentd sets it")
+	txPower      = flagset.Uint("tx-power", 10, "TX power reported until agentd sets it")
+	revSensitive = flagset.Uint("rev-sensitive", 5, "receive sensitivity reported until agentd sets it")
+	antennaOpen  = flagset.Bool("antenna-open", true, "whether the antenna starts open; OBU events are only reported while it is")
+
+	eventRate  = flagset.Float64("event-rate", 1, "OBU events reported per second by each RSU")
+	escapeRate = flagset.Float64("escape-rate", 0.1, "fraction of OBU events carrying bytes that must be escaped on the wire")
+
+	delay           = flagset.Duration("delay", 0, "delay before every response")
+	dropRate        = flagset.Float64("drop-rate", 0, "fraction of requests left unanswered")
+	badBCCRate      = flagset.Float64("bad-bcc-rate", 0, "fraction of frames sent with a corrupt checksum")
+	disconnectAfter = flagset.Duration("disconnect-after", 0, "hang up after this long (0 never)")
+	seed            = flagset.Int64("seed", 0, "random seed, 0 for the current time")
+)
+
+var logger = agent.DefaultLogger()
+
+// run keeps the RSU configured by cfg connected until exitChan closes
+func run(cfg rsusim.Config, exitChan chan int) {
+	id := rsu.DeviceID(cfg.Station, cfg.Roadway)
+	for {
+		r, err := rsusim.Dial(*address, cfg)
+		if err != nil {
+			logger.Error("failed to connect", "rsu", id, "addr", *address, "err", err)
+		} else {
+			logger.Info("connected", "rsu", id, "addr", *address)
+			select {
+			case <-r.Done():
+				logger.Warn("connection lost", "rsu", id, "err", r.Err(), "stats", fmt.Sprintf("%+v", r.Stats()))
+			case <-exitChan:
+				r.Close()
+				logger.Info("stopped", "rsu", id, "stats", fmt.Sprintf("%+v", r.Stats()))
+				return
+			}
+			r.Close()
+		}
+
+		if *reconnect == 0 {
+			return
+		}
+		select {
+		case <-time.After(*reconnect):
+		case <-exitChan:
+			return
+		}
+		if cfg.Seed != 0 {
+			cfg.Seed++
+		}
+	}
+}
+
+func main() {
+	flagset.Parse(os.Args[1:])
+
+	if *showVersion {
+		fmt.Println(util.Version("rsusim"))
+		return
+	}
+
+	lvl, err := agent.ParseLogLevel(*logLevel)
+	if err != nil {
+		logger.Error("invalid log level", "err", err)
+		os.Exit(1)
+	}
+	logger.SetLevel(lvl)
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+
+	exitChan := make(chan int)
+	var wg util.WaitGroupWrapper
+	for i := 0; i < *count; i++ {
+		cfg := rsusim.Config{
+			Station:         uint16(*station),
+			Roadway:         uint8(*roadway + uint(i)),
+			Channel:         uint8(*channel),
+			TxPower:         uint8(*txPower),
+			RevSensitive:    uint8(*revSensitive),
+			AntennaOpen:     *antennaOpen,
+			EventRate:       *eventRate,
+			EscapeRate:      *escapeRate,
+			Delay:           *delay,
+			DropRate:        *dropRate,
+			BadBCCRate:      *badBCCRate,
+			DisconnectAfter: *disconnectAfter,
+		}
+		if *seed != 0 {
+			cfg.Seed = *seed + int64(i)
+		}
+		wg.Wrap(func() { run(cfg, exitChan) })
+	}
+
+	// without --reconnect every RSU may give up on its own
+	doneChan := make(chan int)
+	go func() {
+		wg.Wait()
+		close(doneChan)
+	}()
+
+	select {
+	case <-signalChan:
+		close(exitChan)
+		<-doneChan
+	case <-doneChan:
+	}
+}
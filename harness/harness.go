@@ -0,0 +1,266 @@
+// Package harness runs agentd, the RSU protocol and the REST API in
+// process on ephemeral ports, with in-memory fakes in place of Kafka
+// and MongoDB, so that tests can drive them with simulated RSUs and
+// REST calls without any external services.
+//
+//	h, err := harness.Start(nil)
+//	...
+//	defer h.Close()
+//	r, err := h.AddRSU(rsusim.NewConfig(1203, 4))
+//	c, err := h.WaitClient("1203-4", 5*time.Second)
+//	events, err := h.Sink.WaitFor(rsu.ObuEventTopic, 10, 5*time.Second)
+//	status, err := h.Get("/GW/OnlineRSU", &infos)
+//
+// The heartbeat interval, frame error policy and command timeouts are
+// package level settings of rsu and so shared by every harness.
+package harness
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/aiyi/agent/agent"
+	"github.com/aiyi/agent/rsu"
+	"github.com/aiyi/agent/rsusim"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Harness is a running agentd with its REST API
+type Harness struct {
+	AgentD *agent.AgentD
+	Proto  *rsu.RsuProtocol
+	Rest   *rsu.RestServer
+	Sink   *agent.MemSink
+	Store  *rsu.MemStore
+
+	// store is what agentd and the REST API use, Store unless a test
+	// wraps it
+	store rsu.Store
+
+	// tempDir is the data path created by Start, if any
+	tempDir string
+
+	rsusMtx sync.Mutex
+	rsus    []*rsusim.RSU
+}
+
+// NewOptions returns the options Start uses by default: listening on
+// ephemeral loopback ports, with the data path left for Start to fill
+// in
+func NewOptions() *agent.AgentdOptions {
+	opts := agent.NewAgentdOptions()
+	opts.TcpAddress = "127.0.0.1:0"
+	opts.HttpAddress = "127.0.0.1:0"
+	opts.SwaggerPath = ""
+	return opts
+}
+
+// Start starts agentd and the REST API with opts, or NewOptions if
+// opts is nil. The event sink and store options are ignored in favour
+// of Sink and Store. Without a data path the outboxes are kept in a
+// temporary directory removed by Close.
+func Start(opts *agent.AgentdOptions) (*Harness, error) {
+	return StartWithFakes(opts, agent.NewMemSink(), rsu.NewMemStore())
+}
+
+// StartWithFakes is Start with the given Sink and Store, which tests
+// can set failing before agentd starts
+func StartWithFakes(opts *agent.AgentdOptions, sink *agent.MemSink, store *rsu.MemStore) (*Harness, error) {
+	return start(opts, sink, store, store)
+}
+
+// start is StartWithFakes with agentd and the REST API using store,
+// which wraps fake
+func start(opts *agent.AgentdOptions, sink *agent.MemSink, fake *rsu.MemStore, store rsu.Store) (*Harness, error) {
+	if opts == nil {
+		opts = NewOptions()
+	}
+
+	h := &Harness{
+		Sink:  sink,
+		Store: fake,
+		store: store,
+	}
+
+	if opts.DataPath == "" {
+		dir, err := ioutil.TempDir("", "agentd-harness")
+		if err != nil {
+			return nil, err
+		}
+		o := *opts
+		o.DataPath = dir
+		opts = &o
+		h.tempDir = dir
+	}
+
+	err := h.start(opts)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Harness) start(opts *agent.AgentdOptions) error {
+	proto, err := rsu.NewRsuProtocol(opts, h.store)
+	if err != nil {
+		return err
+	}
+	h.Proto = proto
+
+	// as NewAgentD does for every real sink
+	sink, err := agent.NewDurableSink("mem", h.Sink, opts)
+	if err != nil {
+		return err
+	}
+	a, err := agent.NewAgentDWithSink(opts, proto, sink)
+	if err != nil {
+		sink.Close()
+		return err
+	}
+	h.AgentD = a
+
+	err = a.Main()
+	if err != nil {
+		return err
+	}
+
+	h.Rest = rsu.NewRestServer(a, h.store, proto.Registry(), nil)
+	return h.Rest.Main()
+}
+
+// Close disconnects the simulated RSUs and stops everything Start
+// started
+func (h *Harness) Close() {
+	// in the order agentd shuts down, RSUs still connected
+	if h.AgentD != nil {
+		h.AgentD.Exit()
+	}
+	if h.Proto != nil {
+		h.Proto.Exit()
+	}
+	if h.Rest != nil {
+		h.Rest.Exit()
+	}
+
+	h.rsusMtx.Lock()
+	for _, r := range h.rsus {
+		r.Close()
+	}
+	h.rsus = nil
+	h.rsusMtx.Unlock()
+
+	h.Store.Close()
+	if h.tempDir != "" {
+		os.RemoveAll(h.tempDir)
+	}
+}
+
+// AddRSU connects a simulated RSU, which Close disconnects
+func (h *Harness) AddRSU(cfg rsusim.Config) (*rsusim.RSU, error) {
+	r, err := rsusim.Dial(h.AgentD.TCPAddr().String(), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	h.rsusMtx.Lock()
+	h.rsus = append(h.rsus, r)
+	h.rsusMtx.Unlock()
+	return r, nil
+}
+
+// WaitClient waits up to timeout for a client with the given ID (see
+// AgentD.GetClient) to connect
+func (h *Harness) WaitClient(id string, timeout time.Duration) (*agent.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		c, ok := h.AgentD.GetClient(id)
+		if ok {
+			return c, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("client %s not connected after %s", id, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WaitGone waits up to timeout for the client with the given ID to
+// disconnect
+func (h *Harness) WaitGone(id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, ok := h.AgentD.GetClient(id)
+		if !ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("client %s still connected after %s", id, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// URL returns the URL of path on the REST API
+func (h *Harness) URL(path string) string {
+	return "http://" + h.Rest.Addr().String() + path
+}
+
+// Do calls the REST API, sending in, if not nil, as the JSON request
+// body and decoding a successful JSON response into out, if not nil.
+// It returns the HTTP status code.
+func (h *Harness) Do(method string, path string, in interface{}, out interface{}) (int, error) {
+	var body bytes.Buffer
+	if in != nil {
+		err := json.NewEncoder(&body).Encode(in)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequest(method, h.URL(path), &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if out == nil || resp.StatusCode/100 != 2 || len(buf) == 0 {
+		return resp.StatusCode, nil
+	}
+	err = json.Unmarshal(buf, out)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("%s %s - %s", method, path, err)
+	}
+	return resp.StatusCode, nil
+}
+
+func (h *Harness) Get(path string, out interface{}) (int, error) {
+	return h.Do("GET", path, nil, out)
+}
+
+func (h *Harness) Put(path string, in interface{}, out interface{}) (int, error) {
+	return h.Do("PUT", path, in, out)
+}
+
+func (h *Harness) Post(path string, in interface{}, out interface{}) (int, error) {
+	return h.Do("POST", path, in, out)
+}
+
+func (h *Harness) Delete(path string, in interface{}) (int, error) {
+	return h.Do("DELETE", path, in, nil)
+}
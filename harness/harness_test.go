@@ -0,0 +1,444 @@
+package harness
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aiyi/agent/agent"
+	"github.com/aiyi/agent/rsu"
+	"github.com/aiyi/agent/rsusim"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const waitTimeout = 5 * time.Second
+
+// startRSU starts a harness with one simulated RSU configured by cfg
+// connected to it
+func startRSU(t *testing.T, opts *agent.AgentdOptions, cfg rsusim.Config) (*Harness, *rsusim.RSU) {
+	h, err := Start(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := h.AddRSU(cfg)
+	if err != nil {
+		h.Close()
+		t.Fatal(err)
+	}
+	return h, r
+}
+
+// waitLifecycle waits for a lifecycle event of the given kind about id
+func waitLifecycle(t *testing.T, h *Harness, event string, id string) agent.LifecycleEvent {
+	topic := h.AgentD.Options().LifecycleTopic
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		for _, e := range h.Sink.Events(topic) {
+			var le agent.LifecycleEvent
+			err := json.Unmarshal(e.Body, &le)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if le.Event == event && le.ID == id {
+				return le
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %s event for %s after %s", event, id, waitTimeout)
+	return agent.LifecycleEvent{}
+}
+
+// counterValue returns the value of the counter name with the given
+// labels in the default registry, 0 if it was never incremented
+func counterValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				v, ok := labels[l.GetName()]
+				if ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestOnlineRSU(t *testing.T) {
+	h, _ := startRSU(t, nil, rsusim.NewConfig(1000, 1))
+	defer h.Close()
+
+	_, err := h.WaitClient("1000-1", waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var infos []rsu.RsuInfo
+	status, err := h.Get("/GW/OnlineRSU", &infos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(infos) != 1 || infos[0].ID != "1000-1" {
+		t.Fatalf("GET /GW/OnlineRSU = %d %+v", status, infos)
+	}
+}
+
+func TestSetTxPower(t *testing.T) {
+	h, r := startRSU(t, nil, rsusim.NewConfig(1000, 1))
+	defer h.Close()
+
+	_, err := h.WaitClient("1000-1", waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := h.Put("/RSU/1000-1/TxPower", rsu.TxPower{TxPower: 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatalf("PUT /RSU/1000-1/TxPower = %d", status)
+	}
+	if r.State().TxPower != 3 {
+		t.Fatalf("RSU TxPower %d, want 3", r.State().TxPower)
+	}
+}
+
+func TestObuEvents(t *testing.T) {
+	const n = 10
+
+	cfg := rsusim.NewConfig(1000, 1)
+	cfg.EventRate = 50
+	h, _ := startRSU(t, nil, cfg)
+	defer h.Close()
+
+	published, err := h.Sink.WaitFor(rsu.ObuEventTopic, n, waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range published[:n] {
+		var event rsu.ObuEvent
+		err := json.Unmarshal(e.Body, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Station != 1000 || event.Roadway != 1 || event.SchemaVersion != rsu.ObuEventSchemaVersion {
+			t.Fatalf("published %+v", event)
+		}
+	}
+
+	deadline := time.Now().Add(waitTimeout)
+	for len(h.Store.Events()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d events stored after %s", len(h.Store.Events()), n, waitTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, doc := range h.Store.Events()[:n] {
+		if doc.Station != 1000 || doc.Roadway != 1 {
+			t.Fatalf("stored %+v", doc)
+		}
+	}
+}
+
+// A station or roadway that is not a number in range is rejected
+func TestBadStaRoad(t *testing.T) {
+	h, err := Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for _, path := range []string{
+		"/Station/abc/Roadway/1/TxPower",
+		"/Station/70000/Roadway/1/TxPower",
+		"/Station/1000/Roadway/-1/TxPower",
+		"/Station/1000/Roadway/256/TxPower",
+	} {
+		status, err := h.Get(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusBadRequest {
+			t.Fatalf("GET %s = %d, want %d", path, status, http.StatusBadRequest)
+		}
+	}
+}
+
+// With the sink and the store down from the start agentd still comes
+// up and queues events, which are delivered once they recover
+func TestOutageRecovery(t *testing.T) {
+	const n = 5
+
+	opts := NewOptions()
+	opts.OutboxMaxBackoff = 100 * time.Millisecond
+	sink := agent.NewMemSink()
+	sink.SetError(errors.New("broker down"))
+	store := rsu.NewMemStore()
+	store.SetError(errors.New("database down"))
+	h, err := StartWithFakes(opts, sink, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	cfg := rsusim.NewConfig(1000, 1)
+	cfg.EventRate = 0
+	r, err := h.AddRSU(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.WaitClient("1000-1", waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		err := r.SendObuEvent(rsusim.RandomObuEvent(rnd, 1000, 1, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if len(sink.Events(rsu.ObuEventTopic)) != 0 || len(store.Events()) != 0 {
+		t.Fatal("events delivered during the outage")
+	}
+
+	sink.SetError(nil)
+	store.SetError(nil)
+	_, err = sink.WaitFor(rsu.ObuEventTopic, n, waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(waitTimeout)
+	for len(store.Events()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d events stored after %s", len(store.Events()), n, waitTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the registry is loaded, and the RSU saved, once the store is back
+	h.Proto.Registry().List(h.AgentD)
+	err, rsuDocs := store.ListRsu()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*rsuDocs) != 1 || (*rsuDocs)[0].ID != "1000-1" {
+		t.Fatalf("registry saved %+v", *rsuDocs)
+	}
+}
+
+func TestDroppedResponse(t *testing.T) {
+	opts := NewOptions()
+	opts.CommandTimeout = 200 * time.Millisecond
+	cfg := rsusim.NewConfig(1000, 1)
+	cfg.EventRate = 0
+	cfg.DropRate = 1
+	h, r := startRSU(t, opts, cfg)
+	defer h.Close()
+
+	// an RSU that answers nothing is never identified, but can be
+	// addressed by its IP address as the only client
+	_, err := h.WaitClient("127.0.0.1", waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := h.Put("/RSU/127.0.0.1/TxPower", rsu.TxPower{TxPower: 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusGatewayTimeout {
+		t.Fatalf("PUT /RSU/127.0.0.1/TxPower = %d, want %d", status, http.StatusGatewayTimeout)
+	}
+	if r.Stats().Dropped == 0 {
+		t.Fatal("no request dropped")
+	}
+}
+
+func TestDisconnected(t *testing.T) {
+	h, r := startRSU(t, nil, rsusim.NewConfig(1000, 1))
+	defer h.Close()
+
+	_, err := h.WaitClient("1000-1", waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitLifecycle(t, h, agent.LifecycleIdentified, "1000-1")
+
+	r.Close()
+	err = h.WaitGone("1000-1", waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := waitLifecycle(t, h, agent.LifecycleDisconnected, "1000-1")
+	if e.Reason == "" {
+		t.Fatalf("disconnected event without a reason: %+v", e)
+	}
+}
+
+// panicStore is a MemStore on which TargetIsLocated, which the protocol
+// calls for each OBU event as it is received, panics for the events of
+// obuMAC, crashing the connection that reports them
+type panicStore struct {
+	*rsu.MemStore
+	obuMAC string
+}
+
+func (s panicStore) TargetIsLocated(ObuMAC string) bool {
+	if ObuMAC == s.obuMAC {
+		panic("events of OBU " + ObuMAC + " set to panic")
+	}
+	return s.MemStore.TargetIsLocated(ObuMAC)
+}
+
+// A panic in one connection's handler closes that connection only
+func TestPanicIsolated(t *testing.T) {
+	const obuMAC = "de:ad:be:ef"
+
+	mem := rsu.NewMemStore()
+	h, err := start(nil, agent.NewMemSink(), mem, panicStore{MemStore: mem, obuMAC: obuMAC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	cfg := rsusim.NewConfig(1000, 1)
+	cfg.EventRate = 0
+	r, err := h.AddRSU(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = rsusim.NewConfig(1000, 2)
+	cfg.EventRate = 0
+	_, err = h.AddRSU(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1000-1", "1000-2"} {
+		_, err := h.WaitClient(id, waitTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitLifecycle(t, h, agent.LifecycleIdentified, id)
+	}
+
+	readLoopPanics := map[string]string{"where": "readLoop"}
+	panics := counterValue(t, "agentd_panics_total", readLoopPanics)
+	e := rsusim.RandomObuEvent(rand.New(rand.NewSource(1)), 1000, 1, 0)
+	e.ObuMAC = obuMAC
+	err = r.SendObuEvent(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = h.WaitGone("1000-1", waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := waitLifecycle(t, h, agent.LifecycleDisconnected, "1000-1")
+	if !strings.Contains(le.Reason, "panic") {
+		t.Fatalf("disconnected for %q, want a panic", le.Reason)
+	}
+	if n := counterValue(t, "agentd_panics_total", readLoopPanics); n != panics+1 {
+		t.Fatalf("agentd_panics_total{where=\"readLoop\"} %v, want %v", n, panics+1)
+	}
+
+	_, ok := h.AgentD.GetClient("1000-2")
+	if !ok {
+		t.Fatal("1000-2 disconnected along with 1000-1")
+	}
+	status, err := h.Put("/RSU/1000-2/TxPower", rsu.TxPower{TxPower: 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatalf("PUT /RSU/1000-2/TxPower = %d", status)
+	}
+}
+
+// On exit commands still pending fail with 503, while the events
+// received before are all delivered and stored
+func TestExitDrains(t *testing.T) {
+	const n = 20
+
+	cfg := rsusim.NewConfig(1000, 3)
+	cfg.EventRate = 0
+	cfg.Delay = 500 * time.Millisecond
+	h, r := startRSU(t, nil, cfg)
+	defer h.Close()
+
+	// each command of the identification is delayed too
+	_, err := h.WaitClient("1000-3", waitTimeout+4*cfg.Delay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := map[string]string{"station": "1000", "roadway": "3"}
+	before := counterValue(t, "rsu_obu_events_total", received)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		err := r.SendObuEvent(rsusim.RandomObuEvent(rnd, 1000, 3, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(waitTimeout)
+	for counterValue(t, "rsu_obu_events_total", received) < before+n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d events received after %s", int(counterValue(t, "rsu_obu_events_total", received)-before), n, waitTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	statusc := make(chan int, 1)
+	go func() {
+		status, err := h.Put("/RSU/1000-3/TxPower", rsu.TxPower{TxPower: 3}, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		statusc <- status
+	}()
+	// exit while the RSU sits on the command
+	time.Sleep(cfg.Delay / 5)
+	h.AgentD.Exit()
+
+	status := <-statusc
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("PUT /RSU/1000-3/TxPower = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	published := h.Sink.Events(rsu.ObuEventTopic)
+	stored := h.Store.Events()
+	if len(published) != n || len(stored) != n {
+		t.Fatalf("%d events published and %d stored on exit, want %d", len(published), len(stored), n)
+	}
+	macs := make(map[string]bool)
+	for _, e := range published {
+		var event rsu.ObuEvent
+		err := json.Unmarshal(e.Body, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		macs[event.ObuMAC] = true
+	}
+	for _, doc := range stored {
+		if !macs[doc.ObuMAC] {
+			t.Fatalf("stored %+v was not published", doc)
+		}
+	}
+}
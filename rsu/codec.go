@@ -0,0 +1,192 @@
+package rsu
+
+import (
+	"io"
+)
+
+// Frame layout on the wire:
+//
+//	0xFF 0xFF | seq | type (2) | data | BCC | 0xFF
+//
+// Everything between the start and end markers is escaped so that 0xFF
+// only ever appears as a marker: 0xFE is sent as 0xFE 0x00 and 0xFF as
+// 0xFE 0x01. The BCC is the XOR of the unescaped seq, type and data.
+const (
+	frameMarker byte = 0xFF
+	escapeByte  byte = 0xFE
+)
+
+// Escape appends buf to dst with 0xFE and 0xFF escaped
+func Escape(dst []byte, buf []byte) []byte {
+	for _, b := range buf {
+		if b >= escapeByte {
+			dst = append(dst, escapeByte, b-escapeByte)
+		} else {
+			dst = append(dst, b)
+		}
+	}
+	return dst
+}
+
+// unescape reverses Escape. An escape byte that is last or followed by
+// anything but 0x00 or 0x01 is an InvalidPacketError.
+func unescape(buf []byte) ([]byte, error) {
+	b := make([]byte, 0, len(buf))
+	for k := 0; k < len(buf); k++ {
+		if buf[k] != escapeByte {
+			b = append(b, buf[k])
+			continue
+		}
+		if k+1 >= len(buf) || buf[k+1] > frameMarker-escapeByte {
+			return nil, InvalidPacketError
+		}
+		b = append(b, escapeByte+buf[k+1])
+		k++
+	}
+	return b, nil
+}
+
+func GetBCC(buf []byte) uint8 {
+	n := len(buf)
+	b := uint8(0)
+	for i := 0; i < n; i++ {
+		b ^= buf[i]
+	}
+	return b
+}
+
+// EncodeFrame wraps an unescaped frame body (seq, type and data) with
+// its checksum and markers
+func EncodeFrame(body []byte) []byte {
+	b := make([]byte, 0, 2*len(body)+5)
+	b = append(b, frameMarker, frameMarker)
+	b = Escape(b, body)
+	b = Escape(b, []byte{GetBCC(body)})
+	b = append(b, frameMarker)
+	return b
+}
+
+// ReadFrame reads the next frame from r and returns its unescaped body
+// (seq, type and data) without the checksum. Bytes before the start
+// marker are skipped. The body is returned along with ChecksumError
+// if the checksum does not match. It serves peers that, unlike
+// RsuProtoInst, need not know the length of each message type.
+func ReadFrame(r io.ByteReader) ([]byte, error) {
+	run := 0
+	for run < 2 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == frameMarker {
+			run++
+		} else {
+			run = 0
+		}
+	}
+
+	var raw []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != frameMarker {
+			raw = append(raw, b)
+			continue
+		}
+		if len(raw) == 0 {
+			// a run of markers; the frame starts after the last
+			continue
+		}
+		break
+	}
+
+	body, err := unescape(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 4 {
+		return nil, InvalidPacketError
+	}
+	bcc := body[len(body)-1]
+	body = body[:len(body)-1]
+	if GetBCC(body) != bcc {
+		return body, ChecksumError
+	}
+	return body, nil
+}
+
+// readByte reads a single byte from r, returning a previously unread
+// byte first
+func (p *RsuProtoInst) readByte(r io.Reader) (byte, error) {
+	if p.hasBack {
+		p.hasBack = false
+		return p.back, nil
+	}
+	_, err := io.ReadFull(r, p.one[:])
+	if err != nil {
+		return 0, ReadPacketError
+	}
+	return p.one[0], nil
+}
+
+// unreadByte pushes b back to be returned by the next readByte
+func (p *RsuProtoInst) unreadByte(b byte) {
+	p.back = b
+	p.hasBack = true
+}
+
+// readSTX consumes bytes up to and including the next start marker and
+// returns how many bytes had to be skipped to find it
+func (p *RsuProtoInst) readSTX(r io.Reader) (int, error) {
+	skipped := 0
+	run := 0
+	for {
+		b, err := p.readByte(r)
+		if err != nil {
+			return skipped, err
+		}
+		if b == frameMarker {
+			run++
+			continue
+		}
+		if run >= 2 {
+			// a run longer than two is a stray ETX in front of the STX
+			p.unreadByte(b)
+			return skipped + run - 2, nil
+		}
+		skipped += run + 1
+		run = 0
+	}
+}
+
+// readEscaped fills buf with unescaped frame content. A marker found
+// inside the frame means it was cut short; the marker is left unread
+// so that it can start the next frame.
+func (p *RsuProtoInst) readEscaped(r io.Reader, buf []byte) error {
+	for i := range buf {
+		b, err := p.readByte(r)
+		if err != nil {
+			return err
+		}
+		if b == escapeByte {
+			b, err = p.readByte(r)
+			if err != nil {
+				return err
+			}
+			if b > frameMarker-escapeByte {
+				if b == frameMarker {
+					p.unreadByte(b)
+				}
+				return InvalidPacketError
+			}
+			b += escapeByte
+		} else if b == frameMarker {
+			p.unreadByte(b)
+			return InvalidPacketError
+		}
+		buf[i] = b
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:build go1.18
+
+package rsu
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	. "github.com/aiyi/agent/agent"
+)
+
+// captureSeeds returns the data of the records in direction dir ("in",
+// "out" or "" for both) of the captures in testdata/fuzz, the frames an
+// RSU simulator exchanged with agentd recorded with --capture-path
+func captureSeeds(f *testing.F, dir string) [][]byte {
+	paths, err := filepath.Glob(filepath.Join("testdata", "fuzz", "*.cap"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	if len(paths) == 0 {
+		f.Fatal("no captures in testdata/fuzz")
+	}
+
+	var seeds [][]byte
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		err = ReadCapture(file, func(rec CaptureRecord) error {
+			if dir == "" || rec.Dir == dir {
+				seeds = append(seeds, rec.Data)
+			}
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			f.Fatalf("%s: %s", path, err)
+		}
+	}
+	return seeds
+}
+
+// decodeAll decodes the messages in data until the decoder gives up
+func decodeAll(data []byte) []*RsuMessage {
+	var msgs []*RsuMessage
+	p := &RsuProtoInst{}
+	r := bytes.NewReader(data)
+	for {
+		_, msg, err := p.DecodeMessage(r)
+		if err != nil {
+			return msgs
+		}
+		msgs = append(msgs, msg.(*RsuMessage))
+	}
+}
+
+// Whatever an RSU sends, the decoder must not panic, under any frame
+// error policy, and the messages it accepts must survive re-encoding
+func FuzzDecodeMessage(f *testing.F) {
+	for _, seed := range captureSeeds(f, "in") {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, policy := range []string{"drop", "close", "log"} {
+			withFrameErrorPolicy(t, policy, func() {
+				for _, m := range decodeAll(data) {
+					again := decodeAll(m.Bytes())
+					if len(again) != 1 {
+						t.Fatalf("%s policy: %s re-encoded as % X decodes to %d messages", policy, m, m.Bytes(), len(again))
+					}
+					got := again[0]
+					if got.msgType != m.msgType || got.msgId&seqMask != m.msgId&seqMask || !bytes.Equal(got.data, m.data) {
+						t.Fatalf("%s policy: %s re-encoded decodes to %s data % X, want data % X", policy, m, got, got.data, m.data)
+					}
+				}
+			})
+		}
+	})
+}
+
+// OBU event payloads of any length either decode or fail cleanly, and
+// a decoded event encodes back to a payload that decodes to it again
+func FuzzGetObuEvent(f *testing.F) {
+	for _, seed := range captureSeeds(f, "in") {
+		for _, m := range decodeAll(seed) {
+			if m.msgType == ObuEventReport {
+				f.Add(m.data)
+			}
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := &RsuMessage{msgType: ObuEventReport, data: data}
+		e, err := m.GetObuEvent()
+		if err != nil {
+			return
+		}
+		payload, err := EncodeObuEvent(e)
+		if err != nil {
+			t.Fatalf("%+v: %s", e, err)
+		}
+		again, err := (&RsuMessage{msgType: ObuEventReport, data: payload}).GetObuEvent()
+		if err != nil {
+			t.Fatalf("%+v encoded as % X: %s", e, payload, err)
+		}
+		if !reflect.DeepEqual(again, e) {
+			t.Fatalf("%+v encoded as % X decodes to %+v", e, payload, again)
+		}
+	})
+}
+
+// ReadFrame must not panic on what either side sends, and a body it
+// returns must come back unchanged from EncodeFrame
+func FuzzReadFrame(f *testing.F) {
+	for _, seed := range captureSeeds(f, "") {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		for {
+			body, err := ReadFrame(r)
+			if err != nil && err != ChecksumError {
+				if err == InvalidPacketError {
+					continue
+				}
+				return
+			}
+			again, err := ReadFrame(bufio.NewReader(bytes.NewReader(EncodeFrame(body))))
+			if err != nil {
+				t.Fatalf("% X encoded as % X: %s", body, EncodeFrame(body), err)
+			}
+			if !bytes.Equal(again, body) {
+				t.Fatalf("% X encoded as % X reads back as % X", body, EncodeFrame(body), again)
+			}
+		}
+	})
+}
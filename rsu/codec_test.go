@@ -0,0 +1,108 @@
+package rsu
+
+import (
+	"bufio"
+	"bytes"
+	"sync/atomic"
+	"testing"
+)
+
+// testPayload returns n bytes of data in which the bytes that must be
+// escaped, 0xFE and 0xFF, appear often
+func testPayload(n int, seed byte) []byte {
+	pattern := []byte{0xFE, 0xFF, 0x00, seed, 0x01, 0xFF, 0xFE}
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = pattern[(i+int(seed))%len(pattern)]
+	}
+	return data
+}
+
+// withFrameErrorPolicy runs fn with the frame error policy set to
+// policy, restoring the previous one afterwards
+func withFrameErrorPolicy(t *testing.T, policy string, fn func()) {
+	old := FrameErrorPolicy()
+	err := SetFrameErrorPolicy(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer atomic.StoreInt32(&frameErrorPolicy, old)
+	fn()
+}
+
+// Messages sent by an RSU go through the encoder and agentd's decoder
+func TestResponseRoundTrip(t *testing.T) {
+	for msgType, spec := range responseSpecs {
+		for seq := uint8(0); seq <= seqMask; seq++ {
+			m := &RsuMessage{
+				msgId:   seq,
+				msgType: msgType,
+				data:    testPayload(spec.dataLen, seq),
+			}
+			p := &RsuProtoInst{}
+			frameType, msg, err := p.DecodeMessage(bytes.NewReader(m.Bytes()))
+			if err != nil {
+				t.Fatalf("%s seq %d: %s", spec.name, seq, err)
+			}
+			if frameType != spec.frameType {
+				t.Errorf("%s seq %d: frame type %d, want %d", spec.name, seq, frameType, spec.frameType)
+			}
+			got := msg.(*RsuMessage)
+			if got.msgType != msgType || got.msgId&seqMask != seq || !bytes.Equal(got.data, m.data) {
+				t.Errorf("%s seq %d: decoded %04X seq %d data % X, want %04X data % X",
+					spec.name, seq, got.msgType, got.msgId&seqMask, got.data, msgType, m.data)
+			}
+		}
+	}
+}
+
+// Messages sent by agentd go through the encoder and ReadFrame, the
+// decoder RSU side peers use
+func TestRequestRoundTrip(t *testing.T) {
+	for msgType, spec := range requestSpecs {
+		for seq := uint8(0); seq <= seqMask; seq++ {
+			m := &RsuMessage{
+				msgId:   seq,
+				msgType: msgType,
+				data:    testPayload(spec.dataLen, seq),
+			}
+			body, err := ReadFrame(bufio.NewReader(bytes.NewReader(m.Bytes())))
+			if err != nil {
+				t.Fatalf("%s seq %d: %s", spec.name, seq, err)
+			}
+			if len(body) != 3+spec.dataLen {
+				t.Fatalf("%s seq %d: body % X has %d bytes, want %d", spec.name, seq, body, len(body), 3+spec.dataLen)
+			}
+			if body[0]&seqMask != seq || uint16(body[1])<<8|uint16(body[2]) != msgType || !bytes.Equal(body[3:], m.data) {
+				t.Errorf("%s seq %d: decoded % X, want %04X data % X", spec.name, seq, body, msgType, m.data)
+			}
+		}
+	}
+}
+
+// A 0xFF inside a frame can only be a marker, so the frame was cut short
+func TestUnescapedMarkerInPayload(t *testing.T) {
+	body := []byte{0x80, byte(HeartbeatResponse >> 8), byte(HeartbeatResponse & 0xFF)}
+	frame := []byte{frameMarker, frameMarker}
+	frame = Escape(frame, body)
+	frame = append(frame, 0xFF)
+	frame = Escape(frame, []byte{GetBCC(append(body, 0xFF))})
+	frame = append(frame, frameMarker)
+
+	withFrameErrorPolicy(t, "close", func() {
+		p := &RsuProtoInst{}
+		_, _, err := p.DecodeMessage(bytes.NewReader(frame))
+		if err != InvalidPacketError {
+			t.Fatalf("got %v, want %v", err, InvalidPacketError)
+		}
+	})
+}
+
+func TestUnescapeInvalid(t *testing.T) {
+	for _, raw := range [][]byte{{0x01, escapeByte}, {escapeByte, 0x02}, {escapeByte, 0xFF}} {
+		_, err := unescape(raw)
+		if err != InvalidPacketError {
+			t.Errorf("unescape(% X) = %v, want %v", raw, err, InvalidPacketError)
+		}
+	}
+}
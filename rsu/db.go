@@ -2,181 +2,275 @@ package rsu
 
 import (
 	"fmt"
+	. "github.com/aiyi/agent/agent"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"log"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
+// Tsdb is the MongoDB backed Store. It connects to the server on
+// first use, and again after failing to, so that agentd starts and
+// queues events in its outbox while the server is down.
 type Tsdb struct {
-	session   *mgo.Session
-	obueventC *mgo.Collection
-	tagC      *mgo.Collection
-	targetC   *mgo.Collection
-	tagM      map[uint32]*TagDoc
-	targetM   map[string]*TargetDoc
+	sync.RWMutex
+	addr    string
+	ttl     time.Duration
+	tagM    map[uint32]*TagDoc
+	targetM map[string]*TargetDoc
+
+	sessionMtx sync.Mutex
+	session    *mgo.Session
+	dialErr    error
+	dialTime   time.Time
 }
 
-func NewTsdb() (*Tsdb, error) {
+const (
+	mongoDialTimeout = 5 * time.Second
+	// after a failed dial calls fail straight away for this long, so
+	// that they do not all wait out the dial timeout while the server
+	// is down
+	mongoRedialInterval = 5 * time.Second
+)
+
+// NewTsdb returns the store kept on the MongoDB server at addr. Events
+// expire from the database ttl after they were recorded.
+func NewTsdb(addr string, ttl time.Duration) (*Tsdb, error) {
 	db := &Tsdb{
+		addr:    addr,
+		ttl:     ttl,
 		tagM:    make(map[uint32]*TagDoc),
 		targetM: make(map[string]*TargetDoc),
 	}
 
-	session, err := mgo.Dial("localhost")
+	_, err := db.connect()
 	if err != nil {
-		return nil, err
+		DefaultLogger().Warn("MongoDB unavailable, connecting on first use", "err", err)
 	}
+	return db, nil
+}
 
-	db.session = session
-	c := session.DB("etc").C("obuevent")
-	db.obueventC = c
+// connect returns the session to the server, dialing it first if need
+// be. On connecting it ensures the indexes and loads the tags and
+// targets.
+func (d *Tsdb) connect() (*mgo.Session, error) {
+	d.sessionMtx.Lock()
+	defer d.sessionMtx.Unlock()
 
-	indexes, err := c.Indexes()
-	if err != nil {
-		return nil, err
+	if d.session != nil {
+		return d.session, nil
+	}
+	if d.dialErr != nil && time.Since(d.dialTime) < mongoRedialInterval {
+		return nil, d.dialErr
 	}
 
-	if len(indexes) < 5 {
-		index := mgo.Index{
-			Key:         []string{"DateTime"},
-			Unique:      false,
-			Background:  true,
-			Sparse:      true,
-			ExpireAfter: 60 * 60 * 24 * 7,
+	d.dialTime = time.Now()
+	session, err := mgo.DialWithTimeout(d.addr, mongoDialTimeout)
+	if err == nil {
+		err = ensureIndexes(session.DB("etc").C("obuevent"), d.ttl)
+		if err == nil {
+			err = d.load(session)
+		}
+		if err != nil {
+			session.Close()
 		}
-		c.EnsureIndex(index)
-		c.EnsureIndexKey("Station")
-		c.EnsureIndexKey("Roadway")
-		c.EnsureIndexKey("VehicleNumber")
-		c.EnsureIndexKey("Tags")
+	}
+	if err != nil {
+		d.dialErr = fmt.Errorf("failed to connect to MongoDB at %s - %s", d.addr, err)
+		return nil, d.dialErr
 	}
 
-	db.tagC = session.DB("etc").C("tag")
-	db.targetC = session.DB("etc").C("target")
+	d.session = session
+	d.dialErr = nil
+	return session, nil
+}
 
-	_, tagDocs := db.ListTag()
-	for _, tagDoc := range *tagDocs {
-		staRd := uint32(tagDoc.Station)<<16 | uint32(tagDoc.Roadway)
-		db.tagM[staRd] = &tagDoc
+// collection returns the collection called name, connecting first if
+// need be
+func (d *Tsdb) collection(name string) (*mgo.Collection, error) {
+	session, err := d.connect()
+	if err != nil {
+		return nil, err
 	}
+	return session.DB("etc").C(name), nil
+}
 
-	_, targetDocs := db.ListTarget()
-	for _, targetDoc := range *targetDocs {
-		db.targetM[targetDoc.ObuMAC] = &targetDoc
+// ensureIndexes creates the indexes of the obuevent collection c, and
+// makes events expire ttl after they were recorded, also in a database
+// created with another TTL
+func ensureIndexes(c *mgo.Collection, ttl time.Duration) error {
+	indexes, err := c.Indexes()
+	if err != nil {
+		return err
 	}
 
-	return db, nil
-}
+	ttlIndex := mgo.Index{
+		Key:         []string{"DateTime"},
+		Unique:      false,
+		Background:  true,
+		Sparse:      true,
+		ExpireAfter: ttl,
+	}
+	for _, index := range indexes {
+		if len(index.Key) != 1 || index.Key[0] != "DateTime" {
+			continue
+		}
+		if index.ExpireAfter/time.Second == ttl/time.Second {
+			break
+		}
+
+		if index.ExpireAfter > 0 {
+			err = c.Database.Run(bson.D{
+				{Name: "collMod", Value: c.Name},
+				{Name: "index", Value: bson.M{
+					"keyPattern":         bson.M{"DateTime": 1},
+					"expireAfterSeconds": int(ttl / time.Second),
+				}},
+			}, nil)
+		} else {
+			// only a TTL index can have its TTL changed; the index is
+			// recreated below
+			err = c.DropIndexName(index.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set the event TTL to %s - %s", ttl, err)
+		}
+		DefaultLogger().Info("event TTL changed", "from", index.ExpireAfter, "to", ttl)
+		break
+	}
 
-type EventDoc struct {
-	DateTime      time.Time
-	Station       uint16
-	Roadway       uint8
-	VehicleNumber string
-	ObuMAC        string
-	VehicleType   uint8
-	UserType      uint8
-	Tags          []string
+	err = c.EnsureIndex(ttlIndex)
+	if err != nil {
+		return err
+	}
+	for _, key := range []string{"Station", "Roadway", "VehicleNumber", "Tags"} {
+		err = c.EnsureIndexKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-type TagDoc struct {
-	Station uint16
-	Roadway uint8
-	Tags    []string
+func (d *Tsdb) Reload() error {
+	session, err := d.connect()
+	if err != nil {
+		return err
+	}
+	return d.load(session)
 }
 
-type TargetDoc struct {
-	ObuMAC string
+// load reads the tags and targets into the caches
+func (d *Tsdb) load(session *mgo.Session) error {
+	tagDocs := []TagDoc{}
+	err := session.DB("etc").C("tag").Find(bson.M{}).All(&tagDocs)
+	if err != nil {
+		session.Refresh()
+		return err
+	}
+	tagM := make(map[uint32]*TagDoc)
+	for i := range tagDocs {
+		tagDoc := &tagDocs[i]
+		tagM[staRoadKey(tagDoc.Station, tagDoc.Roadway)] = tagDoc
+	}
+
+	targetDocs := []TargetDoc{}
+	err = session.DB("etc").C("target").Find(bson.M{}).All(&targetDocs)
+	if err != nil {
+		session.Refresh()
+		return err
+	}
+	targetM := make(map[string]*TargetDoc)
+	for i := range targetDocs {
+		targetDoc := &targetDocs[i]
+		targetM[targetDoc.ObuMAC] = targetDoc
+	}
+
+	d.Lock()
+	d.tagM = tagM
+	d.targetM = targetM
+	d.Unlock()
+	return nil
 }
 
 func (d *Tsdb) WriteObuEvent(event *ObuEvent) error {
 	var tags []string
-	staRd := uint32(event.Station)<<16 | uint32(event.Roadway)
-	tagDoc, ok := d.tagM[staRd]
+	d.RLock()
+	tagDoc, ok := d.tagM[staRoadKey(event.Station, event.Roadway)]
 	if ok {
 		tags = tagDoc.Tags
 	}
+	d.RUnlock()
 
-	doc := &EventDoc{
-		DateTime:      time.Unix(event.Timestamp, 0),
-		Station:       event.Station,
-		Roadway:       event.Roadway,
-		VehicleNumber: event.VehicleNumber,
-		ObuMAC:        event.ObuMAC,
-		VehicleType:   event.VehicleType,
-		UserType:      event.UserType,
-		Tags:          tags}
+	doc := newEventDoc(event, tags)
 
-	err := d.obueventC.Insert(doc)
+	c, err := d.collection("obuevent")
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = c.Insert(doc)
+	observeMongoWrite("obuevent", start)
 	if err != nil {
-		log.Fatal(err)
+		// drop the broken socket so the next attempt redials the server
+		c.Database.Session.Refresh()
 		return err
 	}
 	return nil
 }
 
-func (d *Tsdb) FindObuEvent(from, to, station, roadway, vehicle, tags string, events *[]EventDoc) {
+func (d *Tsdb) FindObuEvent(from, to, station, roadway, vehicle, tags string, events *[]EventDoc) error {
+	q, err := parseEventQuery(from, to, station, roadway, vehicle, tags)
+	if err != nil {
+		return err
+	}
+
 	queryM := bson.M{}
 	periodM := bson.M{}
 
-	if from != "" {
-		fromDate, err := time.ParseInLocation("2006-01-02 15:04:05", from, time.Local)
-		if err != nil {
-			return
-		}
-		periodM["$gt"] = fromDate
+	if !q.from.IsZero() {
+		periodM["$gt"] = q.from
 	}
-	if to != "" {
-		toDate, err := time.ParseInLocation("2006-01-02 15:04:05", to, time.Local)
-		if err != nil {
-			return
-		}
-		periodM["$lt"] = toDate
+	if !q.to.IsZero() {
+		periodM["$lt"] = q.to
 	}
 	if len(periodM) > 0 {
 		queryM["datetime"] = periodM
 	}
-	if station != "" {
-		i, err := strconv.ParseUint(station, 10, 16)
-		if err != nil {
-			return
-		}
-		queryM["station"] = uint16(i)
+	if q.hasStation {
+		queryM["station"] = q.station
 	}
-	if roadway != "" {
-		i, err := strconv.ParseUint(roadway, 10, 8)
-		if err != nil {
-			return
-		}
-		queryM["roadway"] = uint8(i)
+	if q.hasRoadway {
+		queryM["roadway"] = q.roadway
 	}
-	if vehicle != "" {
-		queryM["vehiclenumber"] = vehicle
+	if q.vehicle != "" {
+		queryM["vehiclenumber"] = q.vehicle
 	}
-	if tags != "" {
-		taglist := strings.Split(tags, ",")
-		if len(taglist) > 0 {
-			tagM := bson.M{"$all": taglist}
-			queryM["tags"] = tagM
-		}
+	if len(q.tags) > 0 {
+		queryM["tags"] = bson.M{"$all": q.tags}
 	}
 
-	fmt.Println(queryM)
-
-	err := d.obueventC.Find(queryM).Limit(100).All(events)
+	c, err := d.collection("obuevent")
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	err = c.Find(queryM).Limit(eventQueryLimit).All(events)
+	if err != nil {
+		c.Database.Session.Refresh()
+		return err
 	}
+	return nil
 }
 
 func (d *Tsdb) ListTag() (error, *[]TagDoc) {
+	c, err := d.collection("tag")
+	if err != nil {
+		return err, nil
+	}
 	tagdocs := &[]TagDoc{}
-	err := d.tagC.Find(bson.M{}).All(tagdocs)
+	err = c.Find(bson.M{}).All(tagdocs)
 	if err != nil {
-		log.Fatal(err)
+		c.Database.Session.Refresh()
 		return err, nil
 	} else {
 		return nil, tagdocs
@@ -189,22 +283,33 @@ func (d *Tsdb) UpdateTag(station uint16, roadway uint8, tags []string) error {
 		Roadway: roadway,
 		Tags:    tags}
 
-	_, err := d.tagC.Upsert(bson.M{"station": station, "roadway": roadway}, doc)
+	c, err := d.collection("tag")
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	_, err = c.Upsert(bson.M{"station": station, "roadway": roadway}, doc)
+	observeMongoWrite("tag", start)
 	if err != nil {
-		log.Fatal(err)
+		c.Database.Session.Refresh()
 		return err
 	}
 
-	staRd := uint32(station)<<16 | uint32(roadway)
-	d.tagM[staRd] = doc
+	d.Lock()
+	d.tagM[staRoadKey(station, roadway)] = doc
+	d.Unlock()
 	return nil
 }
 
 func (d *Tsdb) ListTarget() (error, *[]TargetDoc) {
+	c, err := d.collection("target")
+	if err != nil {
+		return err, nil
+	}
 	targetdocs := &[]TargetDoc{}
-	err := d.targetC.Find(bson.M{}).All(targetdocs)
+	err = c.Find(bson.M{}).All(targetdocs)
 	if err != nil {
-		log.Fatal(err)
+		c.Database.Session.Refresh()
 		return err, nil
 	} else {
 		return nil, targetdocs
@@ -215,27 +320,46 @@ func (d *Tsdb) AddTarget(ObuMAC string) error {
 	doc := &TargetDoc{
 		ObuMAC: ObuMAC}
 
-	_, err := d.targetC.Upsert(bson.M{"obumac": ObuMAC}, doc)
+	c, err := d.collection("target")
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	start := time.Now()
+	_, err = c.Upsert(bson.M{"obumac": ObuMAC}, doc)
+	observeMongoWrite("target", start)
+	if err != nil {
+		c.Database.Session.Refresh()
 		return err
 	}
 
+	d.Lock()
 	d.targetM[ObuMAC] = doc
+	d.Unlock()
 	return nil
 }
 
 func (d *Tsdb) DeleteTarget(ObuMAC string) error {
-	err := d.targetC.Remove(bson.M{"obumac": ObuMAC})
+	c, err := d.collection("target")
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = c.Remove(bson.M{"obumac": ObuMAC})
+	observeMongoWrite("target", start)
 	if err != nil {
 		return err
 	}
 
+	d.Lock()
 	delete(d.targetM, ObuMAC)
+	d.Unlock()
 	return nil
 }
 
 func (d *Tsdb) TargetIsLocated(ObuMAC string) bool {
+	d.RLock()
+	defer d.RUnlock()
+
 	_, ok := d.targetM[ObuMAC]
 	if ok {
 		return true
@@ -243,8 +367,56 @@ func (d *Tsdb) TargetIsLocated(ObuMAC string) bool {
 	return false
 }
 
+func (d *Tsdb) ListRsu() (error, *[]RsuDoc) {
+	c, err := d.collection("rsu")
+	if err != nil {
+		return err, nil
+	}
+	rsudocs := &[]RsuDoc{}
+	err = c.Find(bson.M{}).All(rsudocs)
+	if err != nil {
+		c.Database.Session.Refresh()
+		return err, nil
+	}
+	return nil, rsudocs
+}
+
+func (d *Tsdb) UpdateRsu(doc *RsuDoc) error {
+	c, err := d.collection("rsu")
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	_, err = c.Upsert(bson.M{"id": doc.ID}, doc)
+	observeMongoWrite("rsu", start)
+	if err != nil {
+		c.Database.Session.Refresh()
+		return err
+	}
+	return nil
+}
+
+func (d *Tsdb) DeleteRsu(ID string) error {
+	c, err := d.collection("rsu")
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = c.Remove(bson.M{"id": ID})
+	observeMongoWrite("rsu", start)
+	if err != nil && err != mgo.ErrNotFound {
+		c.Database.Session.Refresh()
+		return err
+	}
+	return nil
+}
+
 func (d *Tsdb) Close() {
+	d.sessionMtx.Lock()
+	defer d.sessionMtx.Unlock()
+
 	if d.session != nil {
 		d.session.Close()
+		d.session = nil
 	}
 }
@@ -5,12 +5,18 @@ import (
 	rest "github.com/emicklei/go-restful"
 	"net/http"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type Heartbeat struct {
 	Interval int
 }
 
+type Logging struct {
+	Level string
+}
+
 type Tags struct {
 	Tags []string
 }
@@ -19,11 +25,27 @@ type Target struct {
 	ObuMAC string
 }
 
+type ReloadResult struct {
+	// Options changed in the configuration that only take effect
+	// after agentd is restarted
+	Restart []string
+}
+
+// ReloadFunc rereads the agentd configuration and applies it
+type ReloadFunc func() (restart []string, err error)
+
+type Expected struct {
+	Expected bool
+}
+
 type GwService struct {
-	agentd *AgentD
+	agentd   *AgentD
+	store    Store
+	registry *Registry
+	reload   ReloadFunc
 }
 
-func (s GwService) Register() {
+func (s GwService) Register(container *rest.Container) {
 	ws := new(rest.WebService)
 	ws.Path("/GW").
 		Doc("网关系统功能接口").
@@ -35,6 +57,22 @@ func (s GwService) Register() {
 		Operation("findOnlineRsu").
 		Returns(200, "OK", []RsuInfo{}))
 
+	ws.Route(ws.GET("/RSU").To(s.listRsu).
+		Doc("查询已知RSU及其上下线记录").
+		Operation("listRsu").
+		Returns(200, "OK", []RsuStatus{}))
+
+	ws.Route(ws.PUT("/RSU/{ID}").To(s.setRsuExpected).
+		Doc("设置RSU是否应在线").
+		Operation("setRsuExpected").
+		Param(ws.PathParameter("ID", "RSU标识").DataType("string")).
+		Reads(Expected{}))
+
+	ws.Route(ws.DELETE("/RSU/{ID}").To(s.deleteRsu).
+		Doc("删除已知RSU").
+		Operation("deleteRsu").
+		Param(ws.PathParameter("ID", "RSU标识").DataType("string")))
+
 	ws.Route(ws.GET("/OBUEvent").To(s.getObuEvent).
 		Doc("查询OBU事件").
 		Operation("getObuEvent").
@@ -46,11 +84,31 @@ func (s GwService) Register() {
 		Param(ws.QueryParameter("Tags", "标签(tag1,tag2)").DataType("string")).
 		Returns(200, "OK", []EventDoc{}))
 
+	ws.Route(ws.GET("/LogLevel").To(s.getLogLevel).
+		Doc("查询日志级别").
+		Operation("getLogLevel").
+		Writes(Logging{}))
+
+	ws.Route(ws.PUT("/LogLevel").To(s.setLogLevel).
+		Doc("设置日志级别(debug, info, warn, error)").
+		Operation("setLogLevel").
+		Reads(Logging{}))
+
+	ws.Route(ws.GET("/Heartbeat").To(s.getHeartbeatInterval).
+		Doc("查询默认心跳间隔(秒)").
+		Operation("getHeartbeatInterval").
+		Writes(Heartbeat{}))
+
 	ws.Route(ws.PUT("/Heartbeat").To(s.setHeartbeatInterval).
 		Doc("设置心跳消息间隔").
 		Operation("setHeartbeatInterval").
 		Reads(Heartbeat{}))
 
+	ws.Route(ws.POST("/Reload").To(s.reloadConfig).
+		Doc("重新加载配置").
+		Operation("reloadConfig").
+		Returns(200, "OK", ReloadResult{}))
+
 	ws.Route(ws.GET("/Tags").To(s.listTags).
 		Doc("查询站点/车道标签").
 		Operation("listTags").
@@ -78,7 +136,7 @@ func (s GwService) Register() {
 		Operation("deleteTarget").
 		Reads(Target{}))
 
-	rest.Add(ws)
+	container.Add(ws)
 }
 
 func (s GwService) findOnlineRsu(request *rest.Request, response *rest.Response) {
@@ -87,8 +145,14 @@ func (s GwService) findOnlineRsu(request *rest.Request, response *rest.Response)
 
 	a.RLock()
 	for _, c := range a.Clients {
+		p := c.ProtoInstance().(*RsuProtoInst)
 		rsu := &RsuInfo{
-			IP: c.String(),
+			ID:                c.ID(),
+			IP:                c.IP(),
+			HeartbeatInterval: int(p.HeartbeatInterval() / time.Second),
+			RsuParams:         p.Params(),
+			ConnStats:         c.Stats(),
+			FrameStats:        p.FrameStats(),
 		}
 		rsus = append(rsus, rsu)
 	}
@@ -97,6 +161,45 @@ func (s GwService) findOnlineRsu(request *rest.Request, response *rest.Response)
 	response.WriteEntity(rsus)
 }
 
+func (s GwService) listRsu(request *rest.Request, response *rest.Response) {
+	response.WriteEntity(s.registry.List(s.agentd))
+}
+
+func (s GwService) setRsuExpected(request *rest.Request, response *rest.Response) {
+	ent := new(Expected)
+	err := request.ReadEntity(&ent)
+	if err != nil {
+		response.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	err = s.registry.SetExpected(request.PathParameter("ID"), ent.Expected)
+	if err == RsuNotFoundError {
+		response.WriteError(http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		response.WriteError(http.StatusExpectationFailed, err)
+		return
+	}
+
+	response.WriteEntity(ent)
+}
+
+func (s GwService) deleteRsu(request *rest.Request, response *rest.Response) {
+	err := s.registry.Delete(request.PathParameter("ID"))
+	if err == RsuNotFoundError {
+		response.WriteError(http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		response.WriteError(http.StatusExpectationFailed, err)
+		return
+	}
+
+	response.WriteEntity(nil)
+}
+
 func (s GwService) getObuEvent(request *rest.Request, response *rest.Response) {
 	from := request.QueryParameter("FromDate")
 	to := request.QueryParameter("ToDate")
@@ -106,11 +209,46 @@ func (s GwService) getObuEvent(request *rest.Request, response *rest.Response) {
 	tags := request.QueryParameter("Tags")
 
 	events := &[]EventDoc{}
-	db.FindObuEvent(from, to, station, roadway, vehicle, tags, events)
+	err := s.store.FindObuEvent(from, to, station, roadway, vehicle, tags, events)
+	if err != nil {
+		response.WriteError(http.StatusExpectationFailed, err)
+		return
+	}
 
 	response.WriteEntity(events)
 }
 
+func (s GwService) getLogLevel(request *rest.Request, response *rest.Response) {
+	ent := new(Logging)
+	ent.Level = DefaultLogger().Level().String()
+	response.WriteEntity(ent)
+}
+
+func (s GwService) setLogLevel(request *rest.Request, response *rest.Response) {
+	ent := new(Logging)
+	err := request.ReadEntity(&ent)
+	if err != nil {
+		response.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	lvl, err := ParseLogLevel(ent.Level)
+	if err != nil {
+		response.WriteError(http.StatusExpectationFailed, err)
+		return
+	}
+
+	DefaultLogger().SetLevel(lvl)
+	ent.Level = lvl.String()
+	response.WriteEntity(ent)
+}
+
+func (s GwService) getHeartbeatInterval(request *rest.Request, response *rest.Response) {
+	ent := new(Heartbeat)
+	ent.Interval = int(atomic.LoadUint32(&HBInterval))
+	response.WriteEntity(ent)
+}
+
 func (s GwService) setHeartbeatInterval(request *rest.Request, response *rest.Response) {
 	ent := new(Heartbeat)
 	err := request.ReadEntity(&ent)
@@ -123,12 +261,30 @@ func (s GwService) setHeartbeatInterval(request *rest.Request, response *rest.Re
 		return
 	}
 
-	HBInterval = uint32(ent.Interval)
+	atomic.StoreUint32(&HBInterval, uint32(ent.Interval))
+	s.agentd.ResetHeartbeats()
 	response.WriteEntity(ent)
 }
 
+func (s GwService) reloadConfig(request *rest.Request, response *rest.Response) {
+	if s.reload == nil {
+		response.WriteErrorString(http.StatusNotImplemented, "reload not supported")
+		return
+	}
+
+	restart, err := s.reload()
+	if err != nil {
+		response.WriteError(http.StatusExpectationFailed, err)
+		return
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+	response.WriteEntity(ReloadResult{restart})
+}
+
 func (s GwService) listTags(request *rest.Request, response *rest.Response) {
-	err, tagDocs := db.ListTag()
+	err, tagDocs := s.store.ListTag()
 	if err != nil {
 		response.WriteError(http.StatusExpectationFailed, err)
 		return
@@ -166,7 +322,7 @@ func (s GwService) setTags(request *rest.Request, response *rest.Response) {
 		return
 	}
 
-	err = db.UpdateTag(sta, rd, ent.Tags)
+	err = s.store.UpdateTag(sta, rd, ent.Tags)
 	if err != nil {
 		response.WriteError(http.StatusExpectationFailed, err)
 		return
@@ -176,7 +332,7 @@ func (s GwService) setTags(request *rest.Request, response *rest.Response) {
 }
 
 func (s GwService) listTargets(request *rest.Request, response *rest.Response) {
-	err, targetDocs := db.ListTarget()
+	err, targetDocs := s.store.ListTarget()
 	if err != nil {
 		response.WriteError(http.StatusExpectationFailed, err)
 		return
@@ -192,7 +348,7 @@ func (s GwService) addTarget(request *rest.Request, response *rest.Response) {
 		return
 	}
 
-	err = db.AddTarget(ent.ObuMAC)
+	err = s.store.AddTarget(ent.ObuMAC)
 	if err != nil {
 		response.WriteError(http.StatusExpectationFailed, err)
 		return
@@ -209,7 +365,7 @@ func (s GwService) deleteTarget(request *rest.Request, response *rest.Response)
 		return
 	}
 
-	err = db.DeleteTarget(ent.ObuMAC)
+	err = s.store.DeleteTarget(ent.ObuMAC)
 	if err != nil {
 		response.WriteError(http.StatusExpectationFailed, err)
 		return
@@ -0,0 +1,60 @@
+package rsu
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Reasons a frame is counted as corrupt in rsu_frame_errors_total
+const (
+	frameErrorBadSTX      = "bad_stx"
+	frameErrorBadFrame    = "bad_frame"
+	frameErrorBadETX      = "bad_etx"
+	frameErrorBadChecksum = "bad_checksum"
+	frameErrorUnknownType = "unknown_type"
+	frameErrorBadPayload  = "bad_payload"
+)
+
+var (
+	framesDecoded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rsu",
+		Name:      "frames_decoded_total",
+		Help:      "Frames decoded from RSUs, by message type.",
+	}, []string{"type"})
+
+	frameErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rsu",
+		Name:      "frame_errors_total",
+		Help:      "Corrupt frames received from RSUs, by reason.",
+	}, []string{"reason"})
+
+	obuEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rsu",
+		Name:      "obu_events_total",
+		Help:      "OBU events reported by RSUs, by station and roadway.",
+	}, []string{"station", "roadway"})
+
+	mongoWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "rsu",
+		Name:      "mongo_write_duration_seconds",
+		Help:      "Latency of writes to MongoDB, by collection.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"collection"})
+)
+
+func init() {
+	prometheus.MustRegister(framesDecoded, frameErrors, obuEvents, mongoWriteDuration)
+}
+
+// msgTypeLabel formats a message type the way --type-command-timeout
+// takes it
+func msgTypeLabel(msgType uint16) string {
+	return fmt.Sprintf("0x%04X", msgType)
+}
+
+// observeMongoWrite records the latency of a write to collection that
+// started at start
+func observeMongoWrite(collection string, start time.Time) {
+	mongoWriteDuration.WithLabelValues(collection).Observe(time.Since(start).Seconds())
+}
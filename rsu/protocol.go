@@ -1,14 +1,19 @@
 package rsu
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	kafka "github.com/Shopify/sarama"
 	. "github.com/aiyi/agent/agent"
+	"github.com/djimenez/iconv-go"
 	"io"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +24,8 @@ var (
 	MessageUnknownError = errors.New("unknown message type")
 	RsuNotFoundError    = errors.New("RSU not found")
 	SetParameterError   = errors.New("set parameter error")
+	ChecksumError       = errors.New("checksum mismatch")
+	ShortMessageError   = errors.New("message too short")
 )
 
 // Message types
@@ -56,154 +63,475 @@ const (
 	ObuEventReport uint16 = 0xC465
 )
 
+// Event sink topics
+const (
+	ObuEventTopic    = "obu_event"
+	TargetEventTopic = "target_event"
+)
+
+// Frame sequence numbers are handed out in the range 0-7 by msgId; the
+// remaining bits of the sequence byte carry direction flags.
+const seqMask uint8 = 0x07
+
+// A response type differs from its request type only in this bit
+// (0xD371 -> 0xC371, 0xF065 -> 0xE065).
+const requestBit uint16 = 0x1000
+
+// msgSpec describes the payload of a message type and, for messages
+// received by agentd, how the frame is dispatched
+type msgSpec struct {
+	name      string
+	dataLen   int
+	frameType int32
+}
+
+// Messages sent by an RSU
+var responseSpecs = map[uint16]msgSpec{
+	HeartbeatResponse:       {"Heartbeat", 1, FrameTypeMessage},
+	ObuEventReport:          {"OBU Event", 65, FrameTypeMessage},
+	OpenAntResponse:         {"Open Antenna", 1, FrameTypeResponse},
+	CloseAntResponse:        {"Close Antenna", 1, FrameTypeResponse},
+	GetStaRoadResponse:      {"Get Station/Roadway", 3, FrameTypeResponse},
+	GetChannelResponse:      {"Get Channel", 1, FrameTypeResponse},
+	GetTxPowerResponse:      {"Get TxPower", 1, FrameTypeResponse},
+	GetRevSensitiveResponse: {"Get RevSensitive", 1, FrameTypeResponse},
+	SetStaRoadResponse:      {"Set Station/Roadway", 1, FrameTypeResponse},
+	SetTxPowerResponse:      {"Set TxPower", 1, FrameTypeResponse},
+	SetRevSensitiveResponse: {"Set RevSensitive", 1, FrameTypeResponse},
+}
+
+// Messages sent by agentd
+var requestSpecs = map[uint16]msgSpec{
+	HeartbeatRequest:       {"Heartbeat", 0, FrameTypeMessage},
+	OpenAntRequest:         {"Open Antenna", 0, FrameTypeMessage},
+	CloseAntRequest:        {"Close Antenna", 0, FrameTypeMessage},
+	GetStaRoadRequest:      {"Get Station/Roadway", 0, FrameTypeMessage},
+	GetChannelRequest:      {"Get Channel", 0, FrameTypeMessage},
+	GetTxPowerRequest:      {"Get TxPower", 0, FrameTypeMessage},
+	GetRevSensitiveRequest: {"Get RevSensitive", 0, FrameTypeMessage},
+	SetStaRoadRequest:      {"Set Station/Roadway", 3, FrameTypeMessage},
+	SetTxPowerRequest:      {"Set TxPower", 1, FrameTypeMessage},
+	SetRevSensitiveRequest: {"Set RevSensitive", 1, FrameTypeMessage},
+}
+
+// HBInterval is the fleet default heartbeat interval in seconds, used
+// by RSUs without an interval of their own; accessed atomically
 var HBInterval uint32 = 5
 
-type RsuMessage struct {
-	msgId   uint8
-	msgType uint16
-	data    []byte
+// Frame error policies, selecting what DecodeMessage does with a frame
+// that has a bad start marker, checksum, end marker or message type
+const (
+	FrameErrorDrop  int32 = iota // discard the frame and resynchronize
+	FrameErrorClose              // fail the read and close the connection
+	FrameErrorLog                // keep frames whose checksum or ETX is bad
+)
+
+var frameErrorPolicy = FrameErrorDrop
+
+// FrameErrorPolicy returns the policy currently applied to corrupt frames
+func FrameErrorPolicy() int32 {
+	return atomic.LoadInt32(&frameErrorPolicy)
+}
+
+// ParseFrameErrorPolicy returns the corrupt frame policy named by
+// policy: "drop", "close" or "log"
+func ParseFrameErrorPolicy(policy string) (int32, error) {
+	switch policy {
+	case "drop":
+		return FrameErrorDrop, nil
+	case "close":
+		return FrameErrorClose, nil
+	case "log":
+		return FrameErrorLog, nil
+	}
+	return FrameErrorDrop, fmt.Errorf("invalid frame error policy %q (want drop, close or log)", policy)
+}
+
+// SetFrameErrorPolicy selects the corrupt frame policy by name
+func SetFrameErrorPolicy(policy string) error {
+	v, err := ParseFrameErrorPolicy(policy)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&frameErrorPolicy, v)
+	return nil
 }
 
-func (m *RsuMessage) readNBytes(offset int, n int) ([]byte, int) {
-	buf := m.data[offset : offset+n]
-	numFE := 0
+// Per message type overrides of AgentdOptions.CommandTimeout
+var (
+	cmdTimeoutMtx sync.RWMutex
+	cmdTimeouts   = make(map[uint16]time.Duration)
+)
 
-	for i := 0; i < n; i++ {
-		if buf[i] == 0xFE {
-			numFE++
+// SetCommandTimeout overrides the command timeout for requests of
+// msgType. A zero duration restores the agentd default.
+func SetCommandTimeout(msgType uint16, d time.Duration) {
+	cmdTimeoutMtx.Lock()
+	defer cmdTimeoutMtx.Unlock()
+
+	if d <= 0 {
+		delete(cmdTimeouts, msgType)
+		return
+	}
+	cmdTimeouts[msgType] = d
+}
+
+// ParseCommandTimeouts parses overrides given as <msgType>=<duration>,
+// e.g. "0xD067=10s"
+func ParseCommandTimeouts(specs []string) (map[uint16]time.Duration, error) {
+	timeouts := make(map[uint16]time.Duration)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid command timeout %q", spec)
+		}
+		msgType, err := strconv.ParseUint(parts[0], 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message type in command timeout %q - %s", spec, err)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration in command timeout %q - %s", spec, err)
+		}
+		if d > 0 {
+			timeouts[uint16(msgType)] = d
 		}
 	}
+	return timeouts, nil
+}
 
-	if numFE == 0 {
-		return buf, offset + n
+// SetCommandTimeouts replaces the overrides with those given as for
+// ParseCommandTimeouts. Nothing changes if any of them is invalid.
+func SetCommandTimeouts(specs []string) error {
+	timeouts, err := ParseCommandTimeouts(specs)
+	if err != nil {
+		return err
 	}
 
-	b := make([]byte, n)
-	n += numFE
-	buf = m.data[offset : offset+n]
-	i := 0
-	for k := 0; k < n; k++ {
-		if buf[k] != 0xFE {
-			b[i] = buf[k]
-		} else {
-			b[i] = buf[k] + buf[k+1]
-			k++
+	cmdTimeoutMtx.Lock()
+	cmdTimeouts = timeouts
+	cmdTimeoutMtx.Unlock()
+	return nil
+}
+
+type RsuMessage struct {
+	msgId   uint8
+	msgType uint16
+	data    []byte
+}
+
+// readNBytes returns the n bytes of the payload at offset and the
+// offset following them. Reading past the end of the payload yields
+// zeros and sets *err, if not already set, so that a run of reads
+// needs only one check at the end.
+func (m *RsuMessage) readNBytes(offset int, n int, err *error) ([]byte, int) {
+	if offset < 0 || n < 0 || offset+n > len(m.data) {
+		if *err == nil {
+			*err = ShortMessageError
 		}
-		i++
+		return make([]byte, n), offset + n
 	}
-	return b, offset + n
+	return m.data[offset : offset+n], offset + n
+}
+
+// byteAt returns the payload byte at i, 0 if the payload is shorter.
+// The decoder sizes payloads by message type, so only messages built
+// by hand can be short.
+func (m *RsuMessage) byteAt(i int) uint8 {
+	if i >= len(m.data) {
+		return 0
+	}
+	return m.data[i]
 }
 
 func (m *RsuMessage) GetTxPower() uint8 {
-	return m.data[0]
+	return m.byteAt(0)
 }
 
 func (m *RsuMessage) GetRevSensitive() uint8 {
-	return m.data[0]
+	return m.byteAt(0)
 }
 
 func (m *RsuMessage) GetRsuStatus() uint8 {
-	return m.data[0]
+	return m.byteAt(0)
 }
 
 func (m *RsuMessage) GetStation() uint16 {
-	return binary.BigEndian.Uint16(m.data[0:2])
+	return uint16(m.byteAt(0))<<8 | uint16(m.byteAt(1))
 }
 
 func (m *RsuMessage) GetRoadway() uint8 {
-	return m.data[2]
+	return m.byteAt(2)
 }
 
 func (m *RsuMessage) GetChannel() uint8 {
-	return m.data[0]
-}
-
-//RsuTransactionMode	1
-//VehicleNumber			12
-//VehicleType			1
-//UserType				1
-//ContractSN			8
-//ObuMAC				4
-//ObuStatus				2
-//Battery				1
-//Timestamp				4
-//PSAMID				6
-//TrSN					4
-//Station				2
-//Roadway				1
+	return m.byteAt(0)
+}
+
+// ObuEventSchemaVersion identifies the layout of ObuEvent as published
+// to event consumers and kept in EventDoc. Bump it whenever a field is
+// renamed, retyped or removed; adding fields is backwards compatible.
+//
+// Version 1, never labelled as such, carried only Timestamp, Station,
+// Roadway, VehicleNumber, ObuMAC, VehicleType and UserType; events and
+// documents without a SchemaVersion have that layout.
+const ObuEventSchemaVersion = 2
+
+// ObuEvent is an OBU transaction record as reported by an RSU:
+//
+//	RsuTransactionMode	1
+//	VehicleNumber		12
+//	VehicleType		1
+//	UserType		1
+//	ContractSN		8
+//	ObuMAC			4
+//	ObuStatus		2
+//	Battery			1
+//	Timestamp		4
+//	PSAMID			6
+//	TrSN			4
+//	Station			2
+//	Roadway			1
+//	(reserved)		18
 type ObuEvent struct {
-	Timestamp     int64
-	Station       uint16
-	Roadway       uint8
-	VehicleNumber string
-	ObuMAC        string
-	VehicleType   uint8
-	UserType      uint8
+	SchemaVersion      int    `json:"SchemaVersion"`
+	Timestamp          int64  `json:"Timestamp"`
+	Station            uint16 `json:"Station"`
+	Roadway            uint8  `json:"Roadway"`
+	VehicleNumber      string `json:"VehicleNumber"`
+	ObuMAC             string `json:"ObuMAC"`
+	VehicleType        uint8  `json:"VehicleType"`
+	UserType           uint8  `json:"UserType"`
+	RsuTransactionMode uint8  `json:"RsuTransactionMode"`
+	ContractSN         string `json:"ContractSN"`
+	ObuStatus          uint16 `json:"ObuStatus"`
+	Battery            uint8  `json:"Battery"`
+	PSAMID             string `json:"PSAMID"`
+	TrSN               uint32 `json:"TrSN"`
 }
 
-func (m *RsuMessage) GetObuEvent() *ObuEvent {
-	e := &ObuEvent{}
+// GetObuEvent decodes the payload of an ObuEventReport. It fails with
+// ShortMessageError if the payload is too short to hold an event.
+func (m *RsuMessage) GetObuEvent() (*ObuEvent, error) {
+	if m.msgType != ObuEventReport {
+		return nil, fmt.Errorf("%s is not an OBU event", m)
+	}
+
+	e := &ObuEvent{SchemaVersion: ObuEventSchemaVersion}
 	var b []byte
+	var err error
 
-	_, offset := m.readNBytes(0, 1)
-	b, offset = m.readNBytes(offset, 12)
-	e.VehicleNumber, _ = conv.ConvertString(string(b))
-	e.VehicleNumber = strings.TrimRight(e.VehicleNumber, "\u0000")
-	b, offset = m.readNBytes(offset, 1)
+	b, offset := m.readNBytes(0, 1, &err)
+	e.RsuTransactionMode = b[0]
+	b, offset = m.readNBytes(offset, 12, &err)
+	e.VehicleNumber = decodeVehicleNumber(b)
+	b, offset = m.readNBytes(offset, 1, &err)
 	e.VehicleType = b[0]
-	b, offset = m.readNBytes(offset, 1)
+	b, offset = m.readNBytes(offset, 1, &err)
 	e.UserType = b[0]
-	_, offset = m.readNBytes(offset, 8)
-	b, offset = m.readNBytes(offset, 4)
+	b, offset = m.readNBytes(offset, 8, &err)
+	e.ContractSN = hex.EncodeToString(b)
+	b, offset = m.readNBytes(offset, 4, &err)
 	e.ObuMAC = fmt.Sprintf("%02x:%02x:%02x:%02x", b[0], b[1], b[2], b[3])
-	_, offset = m.readNBytes(offset, 3)
-	//e.Battery = b[2]
-	b, offset = m.readNBytes(offset, 4)
+	b, offset = m.readNBytes(offset, 2, &err)
+	e.ObuStatus = binary.BigEndian.Uint16(b)
+	b, offset = m.readNBytes(offset, 1, &err)
+	e.Battery = b[0]
+	b, offset = m.readNBytes(offset, 4, &err)
 	e.Timestamp = int64(binary.BigEndian.Uint32(b[:]))
-	_, offset = m.readNBytes(offset, 6)
-	_, offset = m.readNBytes(offset, 4)
-	b, offset = m.readNBytes(offset, 2)
+	b, offset = m.readNBytes(offset, 6, &err)
+	e.PSAMID = hex.EncodeToString(b)
+	b, offset = m.readNBytes(offset, 4, &err)
+	e.TrSN = binary.BigEndian.Uint32(b)
+	b, offset = m.readNBytes(offset, 2, &err)
 	e.Station = binary.BigEndian.Uint16(b[:])
-	b, offset = m.readNBytes(offset, 1)
+	b, offset = m.readNBytes(offset, 1, &err)
 	e.Roadway = b[0]
-	return e
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// decodeVehicleNumber converts a NUL padded GB 2312 vehicle number to
+// UTF-8. Without a converter, or if the bytes are not GB 2312, the
+// printable ASCII characters are kept so that the event is not lost.
+func decodeVehicleNumber(b []byte) string {
+	b = bytes.TrimRight(b, "\x00")
+	if conv != nil {
+		s, err := conv.ConvertString(string(b))
+		if err == nil {
+			return strings.TrimRight(s, "\u0000")
+		}
+	}
+	return strings.Map(printableASCII, string(b))
+}
+
+// printableASCII maps r to itself if it is printable ASCII and drops it
+// otherwise, for strings.Map
+func printableASCII(r rune) rune {
+	if r < 0x20 || r > 0x7E {
+		return -1
+	}
+	return r
+}
+
+// encodeVehicleNumber is the reverse of decodeVehicleNumber. Without a
+// GB 2312 converter only the printable ASCII part of s is encoded, as
+// decodeVehicleNumber would recover it.
+func encodeVehicleNumber(s string) ([]byte, error) {
+	if gbConv == nil {
+		return []byte(strings.Map(printableASCII, s)), nil
+	}
+	plate, err := gbConv.ConvertString(s)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(plate), nil
+}
+
+// EncodeObuEvent lays e out as the payload of an ObuEventReport, the
+// reverse of GetObuEvent. ContractSN, ObuMAC and PSAMID must be hex as
+// GetObuEvent formats them.
+func EncodeObuEvent(e *ObuEvent) ([]byte, error) {
+	buf := make([]byte, 0, responseSpecs[ObuEventReport].dataLen)
+
+	plate, err := encodeVehicleNumber(e.VehicleNumber)
+	if err != nil {
+		return nil, fmt.Errorf("VehicleNumber - %s", err)
+	}
+	if len(plate) > 12 {
+		return nil, fmt.Errorf("VehicleNumber - longer than 12 bytes")
+	}
+	contractSN, err := hex.DecodeString(e.ContractSN)
+	if err != nil || len(contractSN) != 8 {
+		return nil, fmt.Errorf("ContractSN - want 8 hex bytes")
+	}
+	obuMAC, err := hex.DecodeString(strings.Replace(e.ObuMAC, ":", "", -1))
+	if err != nil || len(obuMAC) != 4 {
+		return nil, fmt.Errorf("ObuMAC - want 4 hex bytes")
+	}
+	psamID, err := hex.DecodeString(e.PSAMID)
+	if err != nil || len(psamID) != 6 {
+		return nil, fmt.Errorf("PSAMID - want 6 hex bytes")
+	}
+
+	buf = append(buf, e.RsuTransactionMode)
+	buf = append(buf, plate...)
+	buf = append(buf, make([]byte, 12-len(plate))...)
+	buf = append(buf, e.VehicleType, e.UserType)
+	buf = append(buf, contractSN...)
+	buf = append(buf, obuMAC...)
+	buf = append(buf, byte(e.ObuStatus>>8), byte(e.ObuStatus))
+	buf = append(buf, e.Battery)
+	buf = append(buf, byte(e.Timestamp>>24), byte(e.Timestamp>>16), byte(e.Timestamp>>8), byte(e.Timestamp))
+	buf = append(buf, psamID...)
+	buf = append(buf, byte(e.TrSN>>24), byte(e.TrSN>>16), byte(e.TrSN>>8), byte(e.TrSN))
+	buf = append(buf, byte(e.Station>>8), byte(e.Station))
+	buf = append(buf, e.Roadway)
+	// the rest of the payload is reserved
+	buf = append(buf, make([]byte, cap(buf)-len(buf))...)
+	return buf, nil
 }
 
-func GetBCC(buf []byte) uint8 {
-	n := len(buf)
-	b := uint8(0)
-	for i := 0; i < n; i++ {
-		b ^= buf[i]
+// Bytes operates on a Message pointer and returns a slice of bytes
+// representing the Message ready for transmission over the network
+func (m *RsuMessage) String() string {
+	name := "Unknown"
+	if spec, ok := requestSpecs[m.msgType]; ok {
+		name = spec.name
+	} else if spec, ok := responseSpecs[m.msgType]; ok {
+		name = spec.name
 	}
-	return b
+	return fmt.Sprintf("%s (%s seq %d)", name, msgTypeLabel(m.msgType), m.msgId&seqMask)
 }
 
-//Bytes operates on a Message pointer and returns a slice of bytes
-//representing the Message ready for transmission over the network
 func (m *RsuMessage) Bytes() []byte {
-	var b []byte
-	b = append(b, 0xFF)
-	b = append(b, 0xFF)
-	b = append(b, 0x80|m.msgId)
-	b = append(b, uint8((m.msgType&0xFF00)>>8))
-	b = append(b, uint8(m.msgType&0x00FF))
-	b = append(b, m.data...)
-	bcc := GetBCC(b[:])
-	if bcc > 0xFD {
-		b = append(b, 0xFE)
-		b = append(b, bcc-0xFE)
-	} else {
-		b = append(b, bcc)
-	}
-	b = append(b, 0xFF)
-	return b
+	body := make([]byte, 0, 3+len(m.data))
+	body = append(body, 0x80|m.msgId)
+	body = append(body, uint8((m.msgType&0xFF00)>>8))
+	body = append(body, uint8(m.msgType&0x00FF))
+	body = append(body, m.data...)
+	return EncodeFrame(body)
+}
+
+// conv decodes the GB 2312 vehicle numbers sent by RSUs, gbConv
+// encodes them
+var conv, gbConv *iconv.Converter
+
+func init() {
+	conv, _ = iconv.NewConverter("gb2312", "utf-8")
+	gbConv, _ = iconv.NewConverter("utf-8", "gb2312")
 }
 
+// RsuProtocol creates the protocol instance of each RSU connection.
+// Decoded OBU events are queued for the store in an on-disk outbox so
+// that they survive store outages.
 type RsuProtocol struct {
+	store       Store
+	storeOutbox *Outbox
+	registry    *Registry
+}
+
+func NewRsuProtocol(opts *AgentdOptions, store Store) (*RsuProtocol, error) {
+	this := &RsuProtocol{
+		store: store,
+	}
+
+	this.registry = NewRegistry(store)
+
+	outbox, err := NewOutbox("store", opts.DataPath, opts.OutboxMaxBytes, opts.OutboxMaxBackoff, this.storeObuEvent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store outbox in %s - %s", opts.DataPath, err)
+	}
+	this.storeOutbox = outbox
+
+	return this, nil
+}
+
+// storeObuEvent writes an event queued in the outbox to the store
+func (this *RsuProtocol) storeObuEvent(topic string, body []byte) error {
+	event := &ObuEvent{}
+	err := json.Unmarshal(body, event)
+	if err != nil {
+		// retrying will not make the record any more readable
+		return ErrPermanent{Err: fmt.Errorf("undecodable record - %s", err)}
+	}
+	return this.store.WriteObuEvent(event)
+}
+
+// Drain waits until deadline for the events queued for the store to be
+// written
+func (this *RsuProtocol) Drain(deadline time.Time) error {
+	n := this.storeOutbox.Flush(deadline)
+	if n > 0 {
+		return fmt.Errorf("%d events not written to the store", n)
+	}
+	return nil
+}
+
+// Exit stops delivering queued events; the rest are delivered on the
+// next start
+func (this *RsuProtocol) Exit() {
+	this.storeOutbox.Close()
+}
+
+// Registry returns the registry of RSUs that have ever connected
+func (this *RsuProtocol) Registry() *Registry {
+	return this.registry
+}
+
+func (this *RsuProtocol) ClientIdentified(c *Conn, oldID string) {
+	this.registry.connected(c, oldID)
+}
+
+func (this *RsuProtocol) ClientClosed(c *Conn, reason string) {
+	this.registry.disconnected(c, reason)
 }
 
 func (this *RsuProtocol) NewProtoInstance(a *AgentD) ProtoInstance {
 	inst := &RsuProtoInst{
+		proto:   this,
 		agentd:  a,
 		seqChan: make(chan uint8, 8),
 	}
@@ -214,12 +542,105 @@ func (this *RsuProtocol) NewProtoInstance(a *AgentD) ProtoInstance {
 	return inst
 }
 
+// FrameStats counts the frames a connection has decoded and the ways
+// in which received frames were found to be corrupt
+type FrameStats struct {
+	Frames       uint64
+	BadFrames    uint64 // bad markers or escapes, or an undecodable payload
+	BadChecksums uint64
+	UnknownTypes uint64
+	ResyncBytes  uint64 // bytes skipped while hunting for a start marker
+}
+
+// RsuParams are the RSU settings last read from, or successfully
+// written to, the RSU. Settings not seen yet are nil.
+type RsuParams struct {
+	Station      *uint16 `json:",omitempty"`
+	Roadway      *uint8  `json:",omitempty"`
+	Channel      *uint8  `json:",omitempty"`
+	TxPower      *uint8  `json:",omitempty"`
+	RevSensitive *uint8  `json:",omitempty"`
+	AntennaOpen  *bool   `json:",omitempty"`
+}
+
 type RsuProtoInst struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	stats FrameStats
+
+	paramsMtx sync.RWMutex
+	params    RsuParams
+
+	// heartbeat interval in seconds, 0 for HBInterval; accessed atomically
+	hbInterval uint32
+	// 1 to log a hex dump of every frame; accessed atomically
+	frameDump uint32
+
+	conn    *Conn
+	proto   *RsuProtocol
 	agentd  *AgentD
 	seqChan chan uint8
-	hdr     [5]byte
+	hdr     [3]byte
 	bcc     [1]byte
-	end     [1]byte
+	one     [1]byte
+	back    byte
+	hasBack bool
+}
+
+// BindConn remembers the connection the instance serves so that log
+// records carry its device ID
+func (p *RsuProtoInst) BindConn(c *Conn) {
+	p.conn = c
+}
+
+// log writes a record about the RSU
+func (p *RsuProtoInst) log(lvl LogLevel, msg string, kv ...interface{}) {
+	if p.conn != nil {
+		p.conn.Log(lvl, msg, kv...)
+		return
+	}
+	DefaultLogger().Log(lvl, msg, kv...)
+}
+
+// SetFrameDump turns hex dumps of the frames sent to and received from
+// the RSU on or off. Dumps are logged at info level.
+func (p *RsuProtoInst) SetFrameDump(on bool) {
+	var v uint32
+	if on {
+		v = 1
+	}
+	atomic.StoreUint32(&p.frameDump, v)
+}
+
+func (p *RsuProtoInst) FrameDump() bool {
+	return atomic.LoadUint32(&p.frameDump) == 1
+}
+
+// logFrame logs a frame sent or received, with a hex dump of the
+// concatenated parts if dumps are on for the RSU. Sent frames are
+// dumped as written; received ones as decoded, without markers and
+// escapes.
+func (p *RsuProtoInst) logFrame(msg string, m *RsuMessage, parts ...[]byte) {
+	kv := []interface{}{"msgType", msgTypeLabel(m.msgType), "seq", m.msgId & seqMask}
+	if p.FrameDump() {
+		var raw []byte
+		for _, part := range parts {
+			raw = append(raw, part...)
+		}
+		p.log(LogLevelInfo, msg, append(kv, "hex", fmt.Sprintf("%x", raw))...)
+		return
+	}
+	p.log(LogLevelDebug, msg, kv...)
+}
+
+// FrameStats returns a snapshot of the frame counters
+func (p *RsuProtoInst) FrameStats() FrameStats {
+	return FrameStats{
+		Frames:       atomic.LoadUint64(&p.stats.Frames),
+		BadFrames:    atomic.LoadUint64(&p.stats.BadFrames),
+		BadChecksums: atomic.LoadUint64(&p.stats.BadChecksums),
+		UnknownTypes: atomic.LoadUint64(&p.stats.UnknownTypes),
+		ResyncBytes:  atomic.LoadUint64(&p.stats.ResyncBytes),
+	}
 }
 
 func (p *RsuProtoInst) msgId() uint8 {
@@ -236,137 +657,114 @@ func (p *RsuProtoInst) NewRsuMessage(msgType uint16, data []byte) *RsuMessage {
 	}
 }
 
+// DecodeMessage reads the next frame from r. Corrupt frames are
+// handled according to the frame error policy; with FrameErrorDrop the
+// decoder skips ahead to the next 0xFFFF start marker instead of
+// failing, so only I/O errors end the connection.
 func (p *RsuProtoInst) DecodeMessage(r io.Reader) (int32, Message, error) {
-	var (
-		m         RsuMessage
-		dataLen   int
-		numFE     int
-		frameType int32
-	)
-
-	_, err := io.ReadFull(r, p.hdr[:])
-	if err != nil {
-		fmt.Println("Read header error")
-		return -1, nil, ReadPacketError
-	}
-	if p.hdr[0] != 0xFF || p.hdr[1] != 0xFF {
-		fmt.Println("Invalid STX")
-		return -1, nil, InvalidPacketError
-	}
-
-	m.msgId = p.hdr[2]
-	m.msgType = uint16(p.hdr[3])<<8 | uint16(p.hdr[4])
-
-	switch m.msgType {
-	case HeartbeatResponse:
-		dataLen = 1
-		frameType = FrameTypeMessage
-		fmt.Printf("Heartbeat <- ")
-	case ObuEventReport:
-		dataLen = 65
-		frameType = FrameTypeMessage
-		fmt.Printf("OBU Event <- ")
-	case OpenAntResponse:
-		dataLen = 1
-		frameType = FrameTypeResponse
-		fmt.Printf("Open Antenna <- ")
-	case CloseAntResponse:
-		dataLen = 1
-		frameType = FrameTypeResponse
-		fmt.Printf("Close Antenna <- ")
-	case GetStaRoadResponse:
-		dataLen = 3
-		frameType = FrameTypeResponse
-		fmt.Printf("Get Station/Roadway <- ")
-	case GetChannelResponse:
-		dataLen = 1
-		frameType = FrameTypeResponse
-		fmt.Printf("Get Channel <- ")
-	case GetTxPowerResponse:
-		dataLen = 1
-		frameType = FrameTypeResponse
-		fmt.Printf("Get TxPower <- ")
-	case GetRevSensitiveResponse:
-		dataLen = 1
-		frameType = FrameTypeResponse
-		fmt.Printf("Get RevSensitive <- ")
-	case SetStaRoadResponse:
-		dataLen = 1
-		frameType = FrameTypeResponse
-		fmt.Printf("Set Station/Roadway <- ")
-	case SetTxPowerResponse:
-		dataLen = 1
-		frameType = FrameTypeResponse
-		fmt.Printf("Set TxPower <- ")
-	case SetRevSensitiveResponse:
-		dataLen = 1
-		frameType = FrameTypeResponse
-		fmt.Printf("Set RevSensitive <- ")
-	default:
-		fmt.Printf("Unknown message type(%x)\n", p.hdr[3:])
-		return -1, nil, MessageUnknownError
-	}
-
-	fmt.Printf("%x", p.hdr)
-
-	if dataLen > 0 {
-		data := make([]byte, dataLen)
-		_, err = io.ReadFull(r, data)
-		if err != nil {
-			fmt.Println("Read payload error")
-			return -1, nil, ReadPacketError
+	for {
+		frameType, m, err := p.decodeFrame(r)
+		if err == nil {
+			atomic.AddUint64(&p.stats.Frames, 1)
+			framesDecoded.WithLabelValues(msgTypeLabel(m.msgType)).Inc()
+			return frameType, m, nil
 		}
-		m.data = data[:]
-
-	moredata:
-		numFE = 0
-		for i := 0; i < dataLen; i++ {
-			if data[i] == 0xFE {
-				numFE++
-			}
+		if err == ReadPacketError {
+			return -1, nil, err
 		}
-		if numFE > 0 {
-			dataLen = numFE
-			data = make([]byte, dataLen)
-			_, err = io.ReadFull(r, data)
-			if err != nil {
-				fmt.Println("Read payload error")
-				return -1, nil, ReadPacketError
+
+		switch FrameErrorPolicy() {
+		case FrameErrorClose:
+			return -1, nil, err
+		case FrameErrorLog:
+			// checksum and ETX errors still yield a usable message
+			if m != nil {
+				p.log(LogLevelWarning, "accepting corrupt frame", "msgType", msgTypeLabel(m.msgType), "seq", m.msgId&seqMask, "err", err)
+				atomic.AddUint64(&p.stats.Frames, 1)
+				framesDecoded.WithLabelValues(msgTypeLabel(m.msgType)).Inc()
+				return frameType, m, nil
 			}
-			m.data = append(m.data, data...)
-			goto moredata
 		}
-
-		fmt.Printf("%x", m.data)
+		p.log(LogLevelWarning, "dropping corrupt frame", "err", err)
 	}
+}
+
+// decodeFrame reads one frame. On checksum or ETX errors the decoded
+// message is returned along with the error.
+func (p *RsuProtoInst) decodeFrame(r io.Reader) (int32, *RsuMessage, error) {
+	var m RsuMessage
 
-	_, err = io.ReadFull(r, p.bcc[:])
+	skipped, err := p.readSTX(r)
 	if err != nil {
-		fmt.Println("Read BCC error")
-		return -1, nil, ReadPacketError
+		return -1, nil, err
 	}
-	fmt.Printf("%x", p.bcc)
-	if p.bcc[0] == 0xFE {
-		_, err = io.ReadFull(r, p.bcc[:])
-		if err != nil {
-			fmt.Println("Read BCC error")
-			return -1, nil, ReadPacketError
+	if skipped > 0 {
+		atomic.AddUint64(&p.stats.ResyncBytes, uint64(skipped))
+		frameErrors.WithLabelValues(frameErrorBadSTX).Inc()
+		p.log(LogLevelWarning, "invalid STX", "skipped", skipped)
+		if FrameErrorPolicy() == FrameErrorClose {
+			atomic.AddUint64(&p.stats.BadFrames, 1)
+			return -1, nil, InvalidPacketError
 		}
-		fmt.Printf("%x", p.bcc)
 	}
 
-	_, err = io.ReadFull(r, p.end[:])
+	err = p.readEscaped(r, p.hdr[:])
+	if err != nil {
+		return -1, nil, p.readError("header", err)
+	}
+
+	m.msgId = p.hdr[0]
+	m.msgType = uint16(p.hdr[1])<<8 | uint16(p.hdr[2])
+
+	spec, ok := responseSpecs[m.msgType]
+	if !ok {
+		p.log(LogLevelWarning, "unknown message type", "msgType", msgTypeLabel(m.msgType), "seq", m.msgId&seqMask)
+		atomic.AddUint64(&p.stats.UnknownTypes, 1)
+		frameErrors.WithLabelValues(frameErrorUnknownType).Inc()
+		return -1, nil, MessageUnknownError
+	}
+	m.data = make([]byte, spec.dataLen)
+	err = p.readEscaped(r, m.data)
 	if err != nil {
-		fmt.Println("Read ETX error")
-		return -1, nil, ReadPacketError
+		return -1, nil, p.readError("payload", err)
 	}
-	fmt.Printf("%x\n", p.end)
-	if p.end[0] != 0xFF {
-		fmt.Println("Invalid ETX")
-		return -1, nil, InvalidPacketError
+	err = p.readEscaped(r, p.bcc[:])
+	if err != nil {
+		return -1, nil, p.readError("BCC", err)
+	}
+	p.logFrame("frame received", &m, p.hdr[:], m.data, p.bcc[:])
+	end, err := p.readByte(r)
+	if err != nil {
+		return -1, nil, err
+	}
+	if end != frameMarker {
+		p.log(LogLevelWarning, "invalid ETX", "msgType", msgTypeLabel(m.msgType), "seq", m.msgId&seqMask)
+		// the byte may belong to whatever follows the damaged frame
+		p.unreadByte(end)
+		atomic.AddUint64(&p.stats.BadFrames, 1)
+		frameErrors.WithLabelValues(frameErrorBadETX).Inc()
+		return spec.frameType, &m, InvalidPacketError
 	}
 
-	return frameType, &m, nil
+	if GetBCC(append(p.hdr[:], m.data...)) != p.bcc[0] {
+		p.log(LogLevelWarning, "invalid BCC", "msgType", msgTypeLabel(m.msgType), "seq", m.msgId&seqMask)
+		atomic.AddUint64(&p.stats.BadChecksums, 1)
+		frameErrors.WithLabelValues(frameErrorBadChecksum).Inc()
+		return spec.frameType, &m, ChecksumError
+	}
+
+	return spec.frameType, &m, nil
+}
+
+// readError logs a failure to read part of a frame and counts frames
+// that were cut short or badly escaped
+func (p *RsuProtoInst) readError(part string, err error) error {
+	if err == InvalidPacketError {
+		p.log(LogLevelWarning, "invalid "+part)
+		atomic.AddUint64(&p.stats.BadFrames, 1)
+		frameErrors.WithLabelValues(frameErrorBadFrame).Inc()
+	}
+	return err
 }
 
 func (p *RsuProtoInst) HandleMessage(msg Message) Message {
@@ -376,34 +774,33 @@ func (p *RsuProtoInst) HandleMessage(msg Message) Message {
 	case HeartbeatResponse:
 		// do nothing
 	case ObuEventReport:
-		event := m.GetObuEvent()
+		event, err := m.GetObuEvent()
+		if err != nil {
+			atomic.AddUint64(&p.stats.BadFrames, 1)
+			frameErrors.WithLabelValues(frameErrorBadPayload).Inc()
+			p.log(LogLevelWarning, "dropping undecodable OBU event", "seq", m.msgId&seqMask, "err", err)
+			return nil
+		}
+		obuEvents.WithLabelValues(strconv.Itoa(int(event.Station)), strconv.Itoa(int(event.Roadway))).Inc()
 		buf, _ := json.Marshal(event)
-		fmt.Println(time.Unix(event.Timestamp, 0))
-		fmt.Println(string(buf))
-
-		msg := &kafka.MessageToSend{Topic: "obu_event", Key: nil, Value: kafka.StringEncoder(buf)}
-		select {
-		case p.agentd.KafkaProducer.Input() <- msg:
-			fmt.Println("> message queued to broker (topic: obu_event)")
-		case err := <-p.agentd.KafkaProducer.Errors():
-			fmt.Println(err)
+		p.log(LogLevelDebug, "OBU event", "station", event.Station, "roadway", event.Roadway,
+			"obuMAC", event.ObuMAC, "vehicle", event.VehicleNumber, "time", time.Unix(event.Timestamp, 0))
+
+		err = p.agentd.Publish(ObuEventTopic, buf)
+		if err != nil {
+			p.log(LogLevelError, "failed to publish OBU event", "topic", ObuEventTopic, "err", err)
 		}
 
-		if db.TargetIsLocated(event.ObuMAC) {
-			msg.Topic = "target_event"
-			select {
-			case p.agentd.KafkaProducer.Input() <- msg:
-				fmt.Println("> message queued to broker (topic: target_event)")
-			case err := <-p.agentd.KafkaProducer.Errors():
-				fmt.Println(err)
+		if p.proto.store.TargetIsLocated(event.ObuMAC) {
+			err = p.agentd.Publish(TargetEventTopic, buf)
+			if err != nil {
+				p.log(LogLevelError, "failed to publish OBU event", "topic", TargetEventTopic, "err", err)
 			}
 		}
 
-		err := db.WriteObuEvent(event)
+		err = p.proto.storeOutbox.Put(ObuEventTopic, buf)
 		if err != nil {
-			fmt.Println(err)
-		} else {
-			fmt.Println("> message stored in db")
+			p.log(LogLevelError, "failed to queue OBU event for the store", "err", err)
 		}
 	}
 
@@ -413,44 +810,123 @@ func (p *RsuProtoInst) HandleMessage(msg Message) Message {
 func (p *RsuProtoInst) WriteMessage(w io.Writer, msg Message) error {
 	m := msg.(*RsuMessage)
 
-	switch m.msgType {
-	case HeartbeatRequest:
-		fmt.Printf("Heartbeat -> ")
-	case OpenAntRequest:
-		fmt.Printf("Open Antenna -> ")
-	case CloseAntRequest:
-		fmt.Printf("Close Antenna -> ")
-	case GetStaRoadRequest:
-		fmt.Printf("Get Station/Roadway -> ")
-	case GetChannelRequest:
-		fmt.Printf("Get Channel -> ")
-	case GetTxPowerRequest:
-		fmt.Printf("Get TxPower -> ")
-	case GetRevSensitiveRequest:
-		fmt.Printf("Get RevSensitive -> ")
-	case SetStaRoadRequest:
-		fmt.Printf("Set Station/Roadway -> ")
-	case SetTxPowerRequest:
-		fmt.Printf("Set TxPower -> ")
-	case SetRevSensitiveRequest:
-		fmt.Printf("Set RevSensitive -> ")
-	default:
-		fmt.Println("Error sending unknown message type")
+	spec, ok := requestSpecs[m.msgType]
+	if !ok {
+		p.log(LogLevelError, "refusing to send unknown message type", "msgType", msgTypeLabel(m.msgType))
 		return MessageUnknownError
 	}
+	if len(m.data) != spec.dataLen {
+		p.log(LogLevelError, "refusing to send message with bad data length",
+			"msgType", msgTypeLabel(m.msgType), "seq", m.msgId&seqMask, "len", len(m.data), "want", spec.dataLen)
+		return InvalidPacketError
+	}
 
 	buf := m.Bytes()
-	fmt.Printf("%x\n", buf)
+	p.logFrame("frame sent", m, buf)
 
 	_, err := w.Write(buf)
 	if err != nil {
-		fmt.Println("Failed to send message")
 		return err
 	}
 
 	return nil
 }
 
+// TransactionID pairs a request with its response by frame sequence
+// number and message type.
+func (p *RsuProtoInst) TransactionID(msg Message) uint32 {
+	m := msg.(*RsuMessage)
+	return uint32(m.msgId&seqMask)<<16 | uint32(m.msgType&^requestBit)
+}
+
+// MessageType labels the command latency metric with the request type
+func (p *RsuProtoInst) MessageType(msg Message) string {
+	return msgTypeLabel(msg.(*RsuMessage).msgType)
+}
+
+// CommandTimeout returns the timeout configured for req's message type,
+// or zero to use the agentd default
+func (p *RsuProtoInst) CommandTimeout(req Message) time.Duration {
+	cmdTimeoutMtx.RLock()
+	defer cmdTimeoutMtx.RUnlock()
+
+	return cmdTimeouts[req.(*RsuMessage).msgType]
+}
+
+// DeviceID returns the ID an RSU is registered under: its station and
+// roadway, which are unique within a deployment
+func DeviceID(station uint16, roadway uint8) string {
+	return fmt.Sprintf("%d-%d", station, roadway)
+}
+
+// Identify queries the station and roadway of the RSU on c, then reads
+// its radio settings so that they show up in the RSU inventory
+func (p *RsuProtoInst) Identify(c *Conn) (string, error) {
+	resp, err := c.SendCommand(p.NewGetStaRoadMsg())
+	if err != nil {
+		return "", err
+	}
+	m := resp.(*RsuMessage)
+
+	// ObserveResponse records the answers; an RSU that does not answer
+	// is still identified
+	c.SendCommand(p.NewGetChannelMsg())
+	c.SendCommand(p.NewGetTxPowerMsg())
+	c.SendCommand(p.NewGetRevSensitiveMsg())
+
+	return DeviceID(m.GetStation(), m.GetRoadway()), nil
+}
+
+// ObserveResponse keeps the RSU settings carried by, or confirmed in,
+// the response to a command
+func (p *RsuProtoInst) ObserveResponse(req Message, resp Message) {
+	q := req.(*RsuMessage)
+	m := resp.(*RsuMessage)
+
+	p.paramsMtx.Lock()
+	defer p.paramsMtx.Unlock()
+
+	switch m.msgType {
+	case GetStaRoadResponse:
+		station, roadway := m.GetStation(), m.GetRoadway()
+		p.params.Station, p.params.Roadway = &station, &roadway
+	case GetChannelResponse:
+		channel := m.GetChannel()
+		p.params.Channel = &channel
+	case GetTxPowerResponse:
+		txPower := m.GetTxPower()
+		p.params.TxPower = &txPower
+	case GetRevSensitiveResponse:
+		revSensitive := m.GetRevSensitive()
+		p.params.RevSensitive = &revSensitive
+	}
+
+	if m.GetRsuStatus() != 0 {
+		return
+	}
+	switch m.msgType {
+	case SetStaRoadResponse:
+		station, roadway := q.GetStation(), q.GetRoadway()
+		p.params.Station, p.params.Roadway = &station, &roadway
+	case SetTxPowerResponse:
+		txPower := q.GetTxPower()
+		p.params.TxPower = &txPower
+	case SetRevSensitiveResponse:
+		revSensitive := q.GetRevSensitive()
+		p.params.RevSensitive = &revSensitive
+	case OpenAntResponse, CloseAntResponse:
+		open := m.msgType == OpenAntResponse
+		p.params.AntennaOpen = &open
+	}
+}
+
+// Params returns the RSU settings known so far
+func (p *RsuProtoInst) Params() RsuParams {
+	p.paramsMtx.RLock()
+	defer p.paramsMtx.RUnlock()
+	return p.params
+}
+
 func (p *RsuProtoInst) NewOpenAntMsg() Message {
 	return p.NewRsuMessage(OpenAntRequest, nil)
 }
@@ -479,7 +955,7 @@ func (p *RsuProtoInst) NewSetStaRoadMsg(station uint16, road uint8) Message {
 	data := make([]byte, 3)
 	binary.BigEndian.PutUint16(data[0:2], station)
 	data[2] = road
-	return p.NewRsuMessage(SetStaRoadRequest, nil)
+	return p.NewRsuMessage(SetStaRoadRequest, data)
 }
 
 func (p *RsuProtoInst) NewSetTxPowerMsg(txPower uint8) Message {
@@ -498,6 +974,25 @@ func (p *RsuProtoInst) NewHeartbeatMsg() Message {
 	return p.NewRsuMessage(HeartbeatRequest, nil)
 }
 
+// HeartbeatInterval returns the interval set for this RSU, or the fleet
+// default HBInterval
 func (p *RsuProtoInst) HeartbeatInterval() time.Duration {
-	return time.Duration(HBInterval) * time.Second
+	secs := atomic.LoadUint32(&p.hbInterval)
+	if secs == 0 {
+		secs = atomic.LoadUint32(&HBInterval)
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// SetHeartbeatInterval sets the heartbeat interval of this RSU in
+// seconds; 0 reverts to the fleet default. Conn.ResetHeartbeat must be
+// called for it to take effect.
+func (p *RsuProtoInst) SetHeartbeatInterval(secs uint32) {
+	atomic.StoreUint32(&p.hbInterval, secs)
+}
+
+// OwnHeartbeatInterval returns the heartbeat interval set for this RSU
+// in seconds, 0 if it follows the fleet default
+func (p *RsuProtoInst) OwnHeartbeatInterval() uint32 {
+	return atomic.LoadUint32(&p.hbInterval)
 }
@@ -0,0 +1,267 @@
+package rsu
+
+import (
+	. "github.com/aiyi/agent/agent"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rsuHistoryLimit caps the connect/disconnect history kept per RSU
+const rsuHistoryLimit = 100
+
+// Registry remembers every RSU that has been identified, so that RSUs
+// that are expected but not connected can be reported
+type Registry struct {
+	sync.Mutex
+	store  Store
+	rsuM   map[string]*RsuDoc
+	loaded bool
+}
+
+// RsuStatus is a registry entry together with the live state of the RSU
+type RsuStatus struct {
+	RsuDoc
+	Online bool
+	// Missing is set for expected RSUs that are not connected
+	Missing bool
+}
+
+// NewRegistry returns the registry kept in store. If the store cannot
+// be read yet the registry is loaded on later use.
+func NewRegistry(store Store) *Registry {
+	r := &Registry{
+		store: store,
+		rsuM:  make(map[string]*RsuDoc),
+	}
+
+	r.Lock()
+	err := r.load()
+	r.Unlock()
+	if err != nil {
+		DefaultLogger().Warn("failed to load RSU registry, retrying on use", "err", err)
+	}
+	return r
+}
+
+// load reads the registry from the store unless it has been already.
+// RSUs seen meanwhile are merged with what the store knows of them.
+func (r *Registry) load() error {
+	if r.loaded {
+		return nil
+	}
+
+	err, rsuDocs := r.store.ListRsu()
+	if err != nil {
+		return err
+	}
+	r.loaded = true
+
+	seen := r.rsuM
+	r.rsuM = make(map[string]*RsuDoc)
+	for i := range *rsuDocs {
+		r.rsuM[(*rsuDocs)[i].ID] = &(*rsuDocs)[i]
+	}
+
+	// RSUs seen while the store was unavailable
+	for id, doc := range seen {
+		stored, ok := r.rsuM[id]
+		if ok {
+			doc.FirstSeen = stored.FirstSeen
+			doc.Expected = stored.Expected
+			if doc.HeartbeatInterval == 0 {
+				doc.HeartbeatInterval = stored.HeartbeatInterval
+			}
+			history := append(stored.History, doc.History...)
+			if len(history) > rsuHistoryLimit {
+				history = history[len(history)-rsuHistoryLimit:]
+			}
+			doc.History = history
+		}
+		r.rsuM[id] = doc
+
+		err := r.store.UpdateRsu(doc)
+		if err != nil {
+			DefaultLogger().Error("failed to save RSU to the registry", "rsu", id, "err", err)
+		}
+	}
+	return nil
+}
+
+// connected records that c has been identified, and that the RSU
+// formerly known as oldID is gone if c was renamed
+func (r *Registry) connected(c *Conn, oldID string) {
+	now := time.Now()
+	id := c.ID()
+
+	r.Lock()
+	defer r.Unlock()
+	r.load()
+
+	old, ok := r.rsuM[oldID]
+	if ok {
+		r.record(old, RsuEvent{
+			Time:   now,
+			Event:  "disconnect",
+			Addr:   c.RemoteAddr(),
+			Reason: "renamed to " + id,
+		})
+	}
+
+	doc, ok := r.rsuM[id]
+	if !ok {
+		doc = &RsuDoc{
+			ID:        id,
+			FirstSeen: now,
+			Expected:  true,
+		}
+		r.rsuM[id] = doc
+	}
+	doc.IP = c.IP()
+	if doc.HeartbeatInterval > 0 {
+		c.ProtoInstance().(*RsuProtoInst).SetHeartbeatInterval(uint32(doc.HeartbeatInterval))
+		c.ResetHeartbeat()
+	}
+	r.record(doc, RsuEvent{
+		Time:  now,
+		Event: "connect",
+		Addr:  c.RemoteAddr(),
+	})
+}
+
+// disconnected records that c closed. Connections that were never
+// identified are not in the registry.
+func (r *Registry) disconnected(c *Conn, reason string) {
+	r.Lock()
+	defer r.Unlock()
+	r.load()
+
+	doc, ok := r.rsuM[c.ID()]
+	if !ok {
+		return
+	}
+	r.record(doc, RsuEvent{
+		Time:   time.Now(),
+		Event:  "disconnect",
+		Addr:   c.RemoteAddr(),
+		Reason: reason,
+	})
+}
+
+// record appends ev to the history of doc and saves it
+func (r *Registry) record(doc *RsuDoc, ev RsuEvent) {
+	doc.LastSeen = ev.Time
+	if ev.Event == "disconnect" {
+		doc.DisconnectReason = ev.Reason
+	}
+
+	n := len(doc.History) + 1
+	if n > rsuHistoryLimit {
+		n = rsuHistoryLimit
+	}
+	history := make([]RsuEvent, 0, n)
+	history = append(history, doc.History[len(doc.History)-(n-1):]...)
+	doc.History = append(history, ev)
+
+	err := r.store.UpdateRsu(doc)
+	if err != nil {
+		DefaultLogger().Error("failed to save RSU to the registry", "rsu", doc.ID, "err", err)
+	}
+}
+
+// SetExpected marks whether the RSU is expected to be connected
+func (r *Registry) SetExpected(ID string, expected bool) error {
+	r.Lock()
+	defer r.Unlock()
+
+	err := r.load()
+	if err != nil {
+		return err
+	}
+
+	doc, ok := r.rsuM[ID]
+	if !ok {
+		return RsuNotFoundError
+	}
+	doc.Expected = expected
+	return r.store.UpdateRsu(doc)
+}
+
+// SetHeartbeatInterval sets the heartbeat interval of c in seconds, 0
+// for the fleet default, and remembers it for when the RSU reconnects.
+// The interval of RSUs not identified yet is not remembered.
+func (r *Registry) SetHeartbeatInterval(c *Conn, secs uint32) error {
+	c.ProtoInstance().(*RsuProtoInst).SetHeartbeatInterval(secs)
+	c.ResetHeartbeat()
+
+	r.Lock()
+	defer r.Unlock()
+
+	err := r.load()
+	if err != nil {
+		return err
+	}
+	doc, ok := r.rsuM[c.ID()]
+	if !ok || doc.HeartbeatInterval == int(secs) {
+		return nil
+	}
+	doc.HeartbeatInterval = int(secs)
+	return r.store.UpdateRsu(doc)
+}
+
+// Delete forgets an RSU, for instance one that was decommissioned
+func (r *Registry) Delete(ID string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	err := r.load()
+	if err != nil {
+		return err
+	}
+
+	_, ok := r.rsuM[ID]
+	if !ok {
+		return RsuNotFoundError
+	}
+	err = r.store.DeleteRsu(ID)
+	if err != nil {
+		return err
+	}
+	delete(r.rsuM, ID)
+	return nil
+}
+
+// List returns every known RSU, sorted by ID, with its live state
+func (r *Registry) List(a *AgentD) []RsuStatus {
+	r.Lock()
+	r.load()
+	rsus := make([]RsuStatus, 0, len(r.rsuM))
+	for _, doc := range r.rsuM {
+		status := RsuStatus{RsuDoc: *doc}
+		status.History = append([]RsuEvent(nil), doc.History...)
+		rsus = append(rsus, status)
+	}
+	r.Unlock()
+
+	a.RLock()
+	for i := range rsus {
+		c, ok := a.Clients[rsus[i].ID]
+		if ok {
+			rsus[i].Online = true
+			if t := c.Stats().LastFrameTime; !t.IsZero() {
+				rsus[i].LastSeen = t
+			}
+		}
+		rsus[i].Missing = rsus[i].Expected && !rsus[i].Online
+	}
+	a.RUnlock()
+
+	sort.Sort(rsuStatusByID(rsus))
+	return rsus
+}
+
+type rsuStatusByID []RsuStatus
+
+func (s rsuStatusByID) Len() int           { return len(s) }
+func (s rsuStatusByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s rsuStatusByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
@@ -1,72 +1,127 @@
 package rsu
 
 import (
+	"fmt"
 	. "github.com/aiyi/agent/agent"
-	"github.com/djimenez/iconv-go"
 	rest "github.com/emicklei/go-restful"
 	"github.com/emicklei/go-restful/swagger"
-	"log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
 	"net/http"
-	"os"
-)
-
-var (
-	db   *Tsdb
-	conv *iconv.Converter
 )
 
 type RestServer struct {
-	agentd *AgentD
-}
+	agentd   *AgentD
+	store    Store
+	registry *Registry
+	reload   ReloadFunc
 
-func NewRestServer(a *AgentD) *RestServer {
-	var err error
-	db, err = NewTsdb()
-	if err != nil {
-		log.Fatal("FATAL: failed to connect to database - %s", err)
-		os.Exit(1)
-	}
-
-	conv, _ = iconv.NewConverter("gb2312", "utf-8")
+	container *rest.Container
+	listener  net.Listener
+	server    *http.Server
+}
 
+// NewRestServer creates the REST API server. reload, if not nil, backs
+// the /GW/Reload endpoint.
+func NewRestServer(a *AgentD, store Store, registry *Registry, reload ReloadFunc) *RestServer {
 	r := &RestServer{
-		agentd: a,
+		agentd:    a,
+		store:     store,
+		registry:  registry,
+		reload:    reload,
+		container: rest.NewContainer(),
 	}
 	return r
 }
 
-func restServer(r *RestServer) {
-	log.Printf("start listening on %s:8080", r.agentd.GetServerIP())
-	log.Fatal(http.ListenAndServe(":8080", nil))
+func (r *RestServer) serve() {
+	addr := r.listener.Addr()
+	DefaultLogger().Info("HTTP: listening", "addr", addr)
+	err := r.server.Serve(r.listener)
+	if err != http.ErrServerClosed {
+		DefaultLogger().Error("HTTP: server failed", "addr", addr, "err", err)
+	}
+	DefaultLogger().Info("HTTP: closing", "addr", addr)
 }
 
-func (r *RestServer) Main() {
-	rsuSvc := &RsuService{r.agentd}
-	rsuSvc.Register()
+// recoverFilter answers a request whose handler panics with a bare 500
+// instead of leaving net/http to drop the connection, and logs the
+// panic with the RSU the request was about, by ID or by station and
+// roadway. The panic value stays in the log; it may hold internals
+// that are no business of API clients.
+func recoverFilter(req *rest.Request, resp *rest.Response, chain *rest.FilterChain) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		kv := []interface{}{"method", req.Request.Method, "path", req.Request.URL.Path}
+		if id := req.PathParameter("ID"); id != "" {
+			kv = append(kv, "rsu", id)
+		} else {
+			kv = append(kv, "station", req.PathParameter("Station"), "roadway", req.PathParameter("Roadway"))
+		}
+		LogPanic(DefaultLogger(), "rest", p, kv...)
+		resp.WriteErrorString(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}()
+	chain.ProcessFilter(req, resp)
+}
 
-	gwSvc := &GwService{r.agentd}
-	gwSvc.Register()
+// Main starts serving the REST API on AgentdOptions.HttpAddress
+func (r *RestServer) Main() error {
+	r.container.Filter(recoverFilter)
 
-	url := "http://" + r.agentd.GetServerIP() + ":8080"
+	rsuSvc := &RsuService{r.agentd, r.registry}
+	rsuSvc.Register(r.container)
+
+	gwSvc := &GwService{r.agentd, r.store, r.registry, r.reload}
+	gwSvc.Register(r.container)
+
+	// the collector reads this server's agentd, so it cannot go in the
+	// default registry along with the package level metrics
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollector(r.agentd))
+	r.container.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, reg}, promhttp.HandlerOpts{}))
+
+	opts := r.agentd.Options()
+	_, port, _ := net.SplitHostPort(opts.HttpAddress)
+	url := "http://" + net.JoinHostPort(r.agentd.GetServerIP(), port)
 
 	// Optionally, you can install the Swagger Service which provides a nice Web UI on your REST API
 	// You need to download the Swagger HTML5 assets and change the FilePath location in the config below.
 	// Open http://localhost:8080/apidocs and enter http://localhost:8080/apidocs.json in the api input field.
 	config := swagger.Config{
-		WebServices:    rest.RegisteredWebServices(), // you control what services are visible
+		WebServices:    r.container.RegisteredWebServices(), // you control what services are visible
 		WebServicesUrl: url,
 		ApiPath:        "/apidocs.json",
 
 		// Optionally, specifiy where the UI is located
 		SwaggerPath:     "/apidocs/",
-		SwaggerFilePath: "/root/go/src/github.com/wordnik/swagger-ui/dist"}
-	swagger.InstallSwaggerService(config)
+		SwaggerFilePath: opts.SwaggerPath}
+	swagger.RegisterSwaggerService(config, r.container)
+
+	listener, err := net.Listen("tcp", opts.HttpAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s - %s", opts.HttpAddress, err)
+	}
+	r.listener = listener
+	r.server = &http.Server{Handler: r.container}
+
+	go r.serve()
+	return nil
+}
 
-	go restServer(r)
+// Addr returns the address the REST API is served on, which differs
+// from AgentdOptions.HttpAddress if that asks for an ephemeral port
+func (r *RestServer) Addr() net.Addr {
+	return r.listener.Addr()
 }
 
+// Exit stops serving the REST API. The store belongs to the caller of
+// NewRestServer, which closes it.
 func (r *RestServer) Exit() {
-	if db != nil {
-		db.Close()
+	if r.server != nil {
+		r.server.Close()
 	}
 }
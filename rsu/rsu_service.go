@@ -1,13 +1,23 @@
 package rsu
 
 import (
+	"fmt"
 	. "github.com/aiyi/agent/agent"
 	rest "github.com/emicklei/go-restful"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// RsuInfo describes a connected RSU
 type RsuInfo struct {
+	ID string
 	IP string
+	// heartbeat interval in seconds in effect for the RSU
+	HeartbeatInterval int
+	RsuParams
+	ConnStats
+	FrameStats
 }
 
 type StaRoad struct {
@@ -27,71 +37,127 @@ type RevSensitive struct {
 	RevSensitive uint8
 }
 
+// FrameDump turns hex dumps of an RSU's frames on or off. Frames sent
+// are dumped as written to the wire; frames received are dumped
+// unescaped, without the start and end markers.
+type FrameDump struct {
+	Enabled bool
+}
+
 type RsuService struct {
-	agentd *AgentD
+	agentd   *AgentD
+	registry *Registry
 }
 
-func (s RsuService) Register() {
+func (s RsuService) Register(container *rest.Container) {
 	ws := new(rest.WebService)
 	ws.Path("/RSU").
 		Doc("查询和设置RSU工作参数").
 		Consumes(rest.MIME_JSON).
 		Produces(rest.MIME_JSON) // you can specify this per route as well
 
-	ws.Route(ws.POST("/{IP}/OpenAnt").To(s.openAnt).
+	s.addRoutes(ws, "/{ID}",
+		ws.PathParameter("ID", "RSU标识(站点号-车道号)或IP地址").DataType("string"))
+
+	container.Add(ws)
+
+	ws = new(rest.WebService)
+	ws.Path("/Station").
+		Doc("按站点和车道查询和设置RSU工作参数").
+		Consumes(rest.MIME_JSON).
+		Produces(rest.MIME_JSON)
+
+	s.addRoutes(ws, "/{Station}/Roadway/{Roadway}",
+		ws.PathParameter("Station", "站点号").DataType("integer"),
+		ws.PathParameter("Roadway", "车道号").DataType("integer"))
+
+	container.Add(ws)
+}
+
+// addRoutes registers the RSU commands under prefix, whose path
+// parameters getClient resolves to a connected RSU
+func (s RsuService) addRoutes(ws *rest.WebService, prefix string, params ...*rest.Parameter) {
+	route := func(b *rest.RouteBuilder) *rest.RouteBuilder {
+		for _, param := range params {
+			b.Param(param)
+		}
+		return b
+	}
+
+	ws.Route(route(ws.POST(prefix+"/OpenAnt").To(s.openAnt)).
 		Doc("打开RSU天线").
 		Operation("openAnt").
-		Param(ws.PathParameter("IP", "IP地址").DataType("string")).
 		Returns(200, "OK", nil))
-	ws.Route(ws.POST("/{IP}/CloseAnt").To(s.closeAnt).
+	ws.Route(route(ws.POST(prefix+"/CloseAnt").To(s.closeAnt)).
 		Doc("关闭RSU天线").
 		Operation("closeAnt").
-		Param(ws.PathParameter("IP", "IP地址").DataType("string")).
 		Returns(200, "OK", nil))
-	ws.Route(ws.GET("/{IP}/StaRoad").To(s.getStaRoad).
+	ws.Route(route(ws.GET(prefix + "/StaRoad").To(s.getStaRoad)).
 		Doc("查询RSU站点和车道").
 		Operation("getStaRoad").
-		Param(ws.PathParameter("IP", "IP地址").DataType("string")).
 		Writes(StaRoad{}))
-	ws.Route(ws.GET("/{IP}/Channel").To(s.getChannel).
+	ws.Route(route(ws.GET(prefix + "/Channel").To(s.getChannel)).
 		Doc("查询RSU通信信道号").
 		Operation("getChannel").
-		Param(ws.PathParameter("IP", "IP地址").DataType("string")).
 		Writes(Channel{}))
-	ws.Route(ws.GET("/{IP}/TxPower").To(s.getTxPower).
+	ws.Route(route(ws.GET(prefix + "/TxPower").To(s.getTxPower)).
 		Doc("查询RSU发射功率级数").
 		Operation("getTxPower").
-		Param(ws.PathParameter("IP", "IP地址").DataType("string")).
 		Writes(TxPower{}))
-	ws.Route(ws.GET("/{IP}/RevSensitive").To(s.getRevSensitive).
+	ws.Route(route(ws.GET(prefix + "/RevSensitive").To(s.getRevSensitive)).
 		Doc("查询RSU接收灵敏度").
 		Operation("getRevSensitive").
-		Param(ws.PathParameter("IP", "IP地址").DataType("string")).
 		Writes(RevSensitive{}))
-	ws.Route(ws.PUT("/{IP}/StaRoad").To(s.setStaRoad).
+	ws.Route(route(ws.GET(prefix + "/Heartbeat").To(s.getHeartbeatInterval)).
+		Doc("查询RSU心跳间隔(秒)").
+		Operation("getHeartbeatInterval").
+		Writes(Heartbeat{}))
+	ws.Route(route(ws.PUT(prefix + "/Heartbeat").To(s.setHeartbeatInterval)).
+		Doc("设置RSU心跳间隔(秒), 0表示使用默认间隔").
+		Operation("setHeartbeatInterval").
+		Reads(Heartbeat{}))
+	ws.Route(route(ws.GET(prefix + "/FrameDump").To(s.getFrameDump)).
+		Doc("查询是否记录RSU报文十六进制内容").
+		Operation("getFrameDump").
+		Writes(FrameDump{}))
+	ws.Route(route(ws.PUT(prefix + "/FrameDump").To(s.setFrameDump)).
+		Doc("设置是否记录RSU报文十六进制内容; 发送报文按线路原样记录, 接收报文记录去转义且不含帧头帧尾的内容").
+		Operation("setFrameDump").
+		Reads(FrameDump{}))
+	ws.Route(route(ws.PUT(prefix + "/StaRoad").To(s.setStaRoad)).
 		Doc("设置RSU站点和车道").
 		Operation("setStaRoad").
-		Param(ws.PathParameter("IP", "IP地址").DataType("string")).
 		Reads(StaRoad{}))
-	ws.Route(ws.PUT("/{IP}/TxPower").To(s.setTxPower).
+	ws.Route(route(ws.PUT(prefix + "/TxPower").To(s.setTxPower)).
 		Doc("设置RSU发射功率级数").
 		Operation("setTxPower").
-		Param(ws.PathParameter("IP", "IP地址").DataType("string")).
 		Reads(TxPower{}))
-	ws.Route(ws.PUT("/{IP}/RevSensitive").To(s.setRevSensitive).
+	ws.Route(route(ws.PUT(prefix + "/RevSensitive").To(s.setRevSensitive)).
 		Doc("设置RSU接收灵敏度").
 		Operation("setRevSensitive").
-		Param(ws.PathParameter("IP", "IP地址").DataType("string")).
 		Reads(RevSensitive{}))
-
-	rest.Add(ws)
 }
 
 func (s RsuService) getClient(request *rest.Request, response *rest.Response) (*Conn, *RsuProtoInst, bool) {
 	a := s.agentd
-	ip := request.PathParameter("IP")
+	id := request.PathParameter("ID")
+	if id == "" {
+		// clients are keyed by the device ID, which is made up of the
+		// station and roadway learned when the RSU connected
+		station, err := strconv.ParseUint(request.PathParameter("Station"), 10, 16)
+		if err != nil {
+			response.WriteError(http.StatusBadRequest, fmt.Errorf("invalid station %q", request.PathParameter("Station")))
+			return nil, nil, false
+		}
+		roadway, err := strconv.ParseUint(request.PathParameter("Roadway"), 10, 8)
+		if err != nil {
+			response.WriteError(http.StatusBadRequest, fmt.Errorf("invalid roadway %q", request.PathParameter("Roadway")))
+			return nil, nil, false
+		}
+		id = DeviceID(uint16(station), uint8(roadway))
+	}
 
-	c, ok := a.GetClient(ip)
+	c, ok := a.GetClient(id)
 	if !ok {
 		response.WriteError(http.StatusNotFound, RsuNotFoundError)
 		return nil, nil, false
@@ -101,15 +167,30 @@ func (s RsuService) getClient(request *rest.Request, response *rest.Response) (*
 	return c, p, true
 }
 
+// writeCommandError reports a failed command, telling an RSU that did
+// not answer in time (504) and agentd shutting down (503) apart from
+// an RSU that refused the command.
+func writeCommandError(response *rest.Response, err error) {
+	if err == ErrTimeout {
+		response.WriteError(http.StatusGatewayTimeout, err)
+		return
+	}
+	if err == ErrStopped {
+		response.WriteError(http.StatusServiceUnavailable, err)
+		return
+	}
+	response.WriteError(http.StatusExpectationFailed, err)
+}
+
 func (s RsuService) openAnt(request *rest.Request, response *rest.Response) {
 	c, p, ok := s.getClient(request, response)
 	if !ok {
 		return
 	}
 
-	resp, e := c.SendCommand(p.NewOpenAntMsg())
+	resp, e := c.SendCommandContext(request.Request.Context(), p.NewOpenAntMsg())
 	if e != nil {
-		response.WriteError(http.StatusExpectationFailed, e)
+		writeCommandError(response, e)
 		return
 	}
 
@@ -127,9 +208,9 @@ func (s RsuService) closeAnt(request *rest.Request, response *rest.Response) {
 		return
 	}
 
-	resp, e := c.SendCommand(p.NewCloseAntMsg())
+	resp, e := c.SendCommandContext(request.Request.Context(), p.NewCloseAntMsg())
 	if e != nil {
-		response.WriteError(http.StatusExpectationFailed, e)
+		writeCommandError(response, e)
 		return
 	}
 
@@ -147,9 +228,9 @@ func (s RsuService) getStaRoad(request *rest.Request, response *rest.Response) {
 		return
 	}
 
-	resp, err := c.SendCommand(p.NewGetStaRoadMsg())
+	resp, err := c.SendCommandContext(request.Request.Context(), p.NewGetStaRoadMsg())
 	if err != nil {
-		response.WriteError(http.StatusExpectationFailed, err)
+		writeCommandError(response, err)
 		return
 	}
 
@@ -165,9 +246,9 @@ func (s RsuService) getChannel(request *rest.Request, response *rest.Response) {
 		return
 	}
 
-	resp, err := c.SendCommand(p.NewGetChannelMsg())
+	resp, err := c.SendCommandContext(request.Request.Context(), p.NewGetChannelMsg())
 	if err != nil {
-		response.WriteError(http.StatusExpectationFailed, err)
+		writeCommandError(response, err)
 		return
 	}
 
@@ -182,9 +263,9 @@ func (s RsuService) getTxPower(request *rest.Request, response *rest.Response) {
 		return
 	}
 
-	resp, err := c.SendCommand(p.NewGetTxPowerMsg())
+	resp, err := c.SendCommandContext(request.Request.Context(), p.NewGetTxPowerMsg())
 	if err != nil {
-		response.WriteError(http.StatusExpectationFailed, err)
+		writeCommandError(response, err)
 		return
 	}
 
@@ -206,9 +287,9 @@ func (s RsuService) setTxPower(request *rest.Request, response *rest.Response) {
 		return
 	}
 
-	resp, e := c.SendCommand(p.NewSetTxPowerMsg(ent.TxPower))
+	resp, e := c.SendCommandContext(request.Request.Context(), p.NewSetTxPowerMsg(ent.TxPower))
 	if e != nil {
-		response.WriteError(http.StatusExpectationFailed, e)
+		writeCommandError(response, e)
 		return
 	}
 
@@ -226,9 +307,9 @@ func (s RsuService) getRevSensitive(request *rest.Request, response *rest.Respon
 		return
 	}
 
-	resp, err := c.SendCommand(p.NewGetRevSensitiveMsg())
+	resp, err := c.SendCommandContext(request.Request.Context(), p.NewGetRevSensitiveMsg())
 	if err != nil {
-		response.WriteError(http.StatusExpectationFailed, err)
+		writeCommandError(response, err)
 		return
 	}
 
@@ -250,9 +331,9 @@ func (s RsuService) setStaRoad(request *rest.Request, response *rest.Response) {
 		return
 	}
 
-	resp, e := c.SendCommand(p.NewSetStaRoadMsg(uint16(ent.Station), ent.Roadway))
+	resp, e := c.SendCommandContext(request.Request.Context(), p.NewSetStaRoadMsg(uint16(ent.Station), ent.Roadway))
 	if e != nil {
-		response.WriteError(http.StatusExpectationFailed, e)
+		writeCommandError(response, e)
 		return
 	}
 
@@ -261,6 +342,13 @@ func (s RsuService) setStaRoad(request *rest.Request, response *rest.Response) {
 		return
 	}
 
+	// the device ID follows the station and roadway
+	id := DeviceID(uint16(ent.Station), ent.Roadway)
+	e = s.agentd.SetClientID(c, id)
+	if e != nil {
+		c.Log(LogLevelWarning, "RSU not renamed", "id", id, "err", e)
+	}
+
 	response.WriteEntity(ent)
 }
 
@@ -277,9 +365,9 @@ func (s RsuService) setRevSensitive(request *rest.Request, response *rest.Respon
 		return
 	}
 
-	resp, e := c.SendCommand(p.NewSetRevSensitiveMsg(ent.RevSensitive))
+	resp, e := c.SendCommandContext(request.Request.Context(), p.NewSetRevSensitiveMsg(ent.RevSensitive))
 	if e != nil {
-		response.WriteError(http.StatusExpectationFailed, e)
+		writeCommandError(response, e)
 		return
 	}
 
@@ -290,3 +378,68 @@ func (s RsuService) setRevSensitive(request *rest.Request, response *rest.Respon
 
 	response.WriteEntity(ent)
 }
+
+func (s RsuService) getHeartbeatInterval(request *rest.Request, response *rest.Response) {
+	_, p, ok := s.getClient(request, response)
+	if !ok {
+		return
+	}
+
+	ent := new(Heartbeat)
+	ent.Interval = int(p.HeartbeatInterval() / time.Second)
+	response.WriteEntity(ent)
+}
+
+func (s RsuService) setHeartbeatInterval(request *rest.Request, response *rest.Response) {
+	c, _, ok := s.getClient(request, response)
+	if !ok {
+		return
+	}
+
+	ent := new(Heartbeat)
+	err := request.ReadEntity(&ent)
+	if err != nil {
+		response.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	if ent.Interval < 0 {
+		response.WriteError(http.StatusExpectationFailed, SetParameterError)
+		return
+	}
+
+	err = s.registry.SetHeartbeatInterval(c, uint32(ent.Interval))
+	if err != nil {
+		response.WriteError(http.StatusExpectationFailed, err)
+		return
+	}
+
+	response.WriteEntity(ent)
+}
+
+func (s RsuService) getFrameDump(request *rest.Request, response *rest.Response) {
+	_, p, ok := s.getClient(request, response)
+	if !ok {
+		return
+	}
+
+	ent := new(FrameDump)
+	ent.Enabled = p.FrameDump()
+	response.WriteEntity(ent)
+}
+
+func (s RsuService) setFrameDump(request *rest.Request, response *rest.Response) {
+	_, p, ok := s.getClient(request, response)
+	if !ok {
+		return
+	}
+
+	ent := new(FrameDump)
+	err := request.ReadEntity(&ent)
+	if err != nil {
+		response.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	p.SetFrameDump(ent.Enabled)
+	response.WriteEntity(ent)
+}
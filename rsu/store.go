@@ -0,0 +1,211 @@
+package rsu
+
+import (
+	"fmt"
+	. "github.com/aiyi/agent/agent"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FindObuEvent returns at most this many events
+const eventQueryLimit = 100
+
+// Store persists OBU events together with the station/roadway tags and
+// the target OBUs managed through the REST API
+type Store interface {
+	WriteObuEvent(event *ObuEvent) error
+	FindObuEvent(from, to, station, roadway, vehicle, tags string, events *[]EventDoc) error
+
+	ListTag() (error, *[]TagDoc)
+	UpdateTag(station uint16, roadway uint8, tags []string) error
+
+	ListTarget() (error, *[]TargetDoc)
+	AddTarget(ObuMAC string) error
+	DeleteTarget(ObuMAC string) error
+	TargetIsLocated(ObuMAC string) bool
+
+	ListRsu() (error, *[]RsuDoc)
+	UpdateRsu(doc *RsuDoc) error
+	DeleteRsu(ID string) error
+
+	// Reload refreshes the cached tags and targets from their backing
+	// storage, picking up changes made outside agentd
+	Reload() error
+
+	Close()
+}
+
+// NewStore opens the store selected by opts.Store: "mongo" for the
+// MongoDB server at opts.MongoAddress or "file" for an embedded store
+// kept under opts.DataPath
+func NewStore(opts *AgentdOptions) (Store, error) {
+	switch opts.Store {
+	case "mongo":
+		return NewTsdb(opts.MongoAddress, opts.EventTTL)
+	case "file":
+		return NewFileStore(filepath.Join(opts.DataPath, "store"), opts.EventTTL)
+	}
+	return nil, fmt.Errorf("unknown store %q (want mongo or file)", opts.Store)
+}
+
+type EventDoc struct {
+	// ObuEventSchemaVersion of the event, 0 for version 1 documents
+	SchemaVersion      int
+	DateTime           time.Time
+	Station            uint16
+	Roadway            uint8
+	VehicleNumber      string
+	ObuMAC             string
+	VehicleType        uint8
+	UserType           uint8
+	RsuTransactionMode uint8
+	ContractSN         string
+	ObuStatus          uint16
+	Battery            uint8
+	PSAMID             string
+	TrSN               uint32
+	Tags               []string
+}
+
+func newEventDoc(event *ObuEvent, tags []string) *EventDoc {
+	return &EventDoc{
+		SchemaVersion:      event.SchemaVersion,
+		DateTime:           time.Unix(event.Timestamp, 0),
+		Station:            event.Station,
+		Roadway:            event.Roadway,
+		VehicleNumber:      event.VehicleNumber,
+		ObuMAC:             event.ObuMAC,
+		VehicleType:        event.VehicleType,
+		UserType:           event.UserType,
+		RsuTransactionMode: event.RsuTransactionMode,
+		ContractSN:         event.ContractSN,
+		ObuStatus:          event.ObuStatus,
+		Battery:            event.Battery,
+		PSAMID:             event.PSAMID,
+		TrSN:               event.TrSN,
+		Tags:               tags}
+}
+
+type TagDoc struct {
+	Station uint16
+	Roadway uint8
+	Tags    []string
+}
+
+type TargetDoc struct {
+	ObuMAC string
+}
+
+// RsuDoc is the registry record of an RSU that has connected at least
+// once
+type RsuDoc struct {
+	ID        string
+	IP        string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Expected RSUs are reported as missing while disconnected
+	Expected         bool
+	DisconnectReason string
+	// heartbeat interval in seconds applied whenever the RSU connects,
+	// 0 for the fleet default
+	HeartbeatInterval int `json:",omitempty" bson:",omitempty"`
+	History           []RsuEvent
+}
+
+// RsuEvent is a connect or disconnect in an RSU's history
+type RsuEvent struct {
+	Time   time.Time
+	Event  string
+	Addr   string
+	Reason string `json:",omitempty" bson:",omitempty"`
+}
+
+func staRoadKey(station uint16, roadway uint8) uint32 {
+	return uint32(station)<<16 | uint32(roadway)
+}
+
+// eventQuery holds the parsed OBU event search parameters
+type eventQuery struct {
+	from       time.Time
+	to         time.Time
+	hasStation bool
+	station    uint16
+	hasRoadway bool
+	roadway    uint8
+	vehicle    string
+	tags       []string
+}
+
+func parseEventQuery(from, to, station, roadway, vehicle, tags string) (*eventQuery, error) {
+	q := &eventQuery{
+		vehicle: vehicle,
+	}
+
+	if from != "" {
+		fromDate, err := time.ParseInLocation("2006-01-02 15:04:05", from, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		q.from = fromDate
+	}
+	if to != "" {
+		toDate, err := time.ParseInLocation("2006-01-02 15:04:05", to, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		q.to = toDate
+	}
+	if station != "" {
+		i, err := strconv.ParseUint(station, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		q.hasStation = true
+		q.station = uint16(i)
+	}
+	if roadway != "" {
+		i, err := strconv.ParseUint(roadway, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		q.hasRoadway = true
+		q.roadway = uint8(i)
+	}
+	if tags != "" {
+		q.tags = strings.Split(tags, ",")
+	}
+	return q, nil
+}
+
+func (q *eventQuery) match(doc *EventDoc) bool {
+	if !q.from.IsZero() && !doc.DateTime.After(q.from) {
+		return false
+	}
+	if !q.to.IsZero() && !doc.DateTime.Before(q.to) {
+		return false
+	}
+	if q.hasStation && doc.Station != q.station {
+		return false
+	}
+	if q.hasRoadway && doc.Roadway != q.roadway {
+		return false
+	}
+	if q.vehicle != "" && doc.VehicleNumber != q.vehicle {
+		return false
+	}
+	for _, tag := range q.tags {
+		found := false
+		for _, t := range doc.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,377 @@
+package rsu
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore is an embedded Store that needs no database server. Events
+// are appended as JSON lines to obuevent.jsonl and pruned to the TTL;
+// tags, targets and the RSU registry are small enough to be rewritten
+// whole on change.
+type FileStore struct {
+	sync.RWMutex
+	dir       string
+	ttl       time.Duration
+	eventFile *os.File
+	tagM      map[uint32]*TagDoc
+	targetM   map[string]*TargetDoc
+	rsuM      map[string]*RsuDoc
+
+	exitChan chan int
+	wg       sync.WaitGroup
+}
+
+func NewFileStore(dir string, ttl time.Duration) (*FileStore, error) {
+	s := &FileStore{
+		dir:      dir,
+		ttl:      ttl,
+		exitChan: make(chan int),
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	var rsuDocs []RsuDoc
+	err = s.readJSON("rsu.json", &rsuDocs)
+	if err != nil {
+		return nil, err
+	}
+	s.rsuM = make(map[string]*RsuDoc)
+	for i := range rsuDocs {
+		s.rsuM[rsuDocs[i].ID] = &rsuDocs[i]
+	}
+
+	err = s.prune()
+	if err != nil {
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.pruneLoop()
+
+	return s, nil
+}
+
+// Reload rereads tag.json and target.json, which may have been edited
+// by hand
+func (s *FileStore) Reload() error {
+	var tagDocs []TagDoc
+	err := s.readJSON("tag.json", &tagDocs)
+	if err != nil {
+		return err
+	}
+	tagM := make(map[uint32]*TagDoc)
+	for i := range tagDocs {
+		tagM[staRoadKey(tagDocs[i].Station, tagDocs[i].Roadway)] = &tagDocs[i]
+	}
+
+	var targetDocs []TargetDoc
+	err = s.readJSON("target.json", &targetDocs)
+	if err != nil {
+		return err
+	}
+	targetM := make(map[string]*TargetDoc)
+	for i := range targetDocs {
+		targetM[targetDocs[i].ObuMAC] = &targetDocs[i]
+	}
+
+	s.Lock()
+	s.tagM = tagM
+	s.targetM = targetM
+	s.Unlock()
+	return nil
+}
+
+func (s *FileStore) eventPath() string {
+	return filepath.Join(s.dir, "obuevent.jsonl")
+}
+
+func (s *FileStore) WriteObuEvent(event *ObuEvent) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var tags []string
+	tagDoc, ok := s.tagM[staRoadKey(event.Station, event.Roadway)]
+	if ok {
+		tags = tagDoc.Tags
+	}
+
+	line, err := json.Marshal(newEventDoc(event, tags))
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	_, err = s.eventFile.Write(line)
+	if err != nil {
+		return err
+	}
+	return s.eventFile.Sync()
+}
+
+func (s *FileStore) FindObuEvent(from, to, station, roadway, vehicle, tags string, events *[]EventDoc) error {
+	q, err := parseEventQuery(from, to, station, roadway, vehicle, tags)
+	if err != nil {
+		return err
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.scanEvents(func(doc *EventDoc) bool {
+		if q.match(doc) {
+			*events = append(*events, *doc)
+		}
+		return len(*events) < eventQueryLimit
+	})
+}
+
+// scanEvents calls fn for each stored event, oldest first, until fn
+// returns false
+func (s *FileStore) scanEvents(fn func(doc *EventDoc) bool) error {
+	f, err := os.Open(s.eventPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	for scanner.Scan() {
+		doc := &EventDoc{}
+		if json.Unmarshal(scanner.Bytes(), doc) != nil {
+			// a line torn by a crash mid-write
+			continue
+		}
+		if !fn(doc) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// prune rewrites the event file without events older than the TTL
+func (s *FileStore) prune() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.eventFile != nil {
+		s.eventFile.Close()
+		s.eventFile = nil
+	}
+
+	tmp, err := os.Create(s.eventPath() + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	expiry := time.Now().Add(-s.ttl)
+	var encErr error
+	err = s.scanEvents(func(doc *EventDoc) bool {
+		if doc.DateTime.After(expiry) {
+			encErr = enc.Encode(doc)
+		}
+		return encErr == nil
+	})
+	if err == nil {
+		err = encErr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.eventPath())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	// keep appending to whatever is there even if pruning failed
+	f, ferr := os.OpenFile(s.eventPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if ferr != nil {
+		return ferr
+	}
+	s.eventFile = f
+	return err
+}
+
+func (s *FileStore) pruneLoop() {
+	ticker := time.NewTicker(time.Hour)
+	for {
+		select {
+		case <-ticker.C:
+			s.prune()
+		case <-s.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	ticker.Stop()
+	s.wg.Done()
+}
+
+func (s *FileStore) ListTag() (error, *[]TagDoc) {
+	s.RLock()
+	defer s.RUnlock()
+
+	tagdocs := make([]TagDoc, 0, len(s.tagM))
+	for _, doc := range s.tagM {
+		tagdocs = append(tagdocs, *doc)
+	}
+	return nil, &tagdocs
+}
+
+func (s *FileStore) UpdateTag(station uint16, roadway uint8, tags []string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.tagM[staRoadKey(station, roadway)] = &TagDoc{
+		Station: station,
+		Roadway: roadway,
+		Tags:    tags}
+
+	tagdocs := make([]TagDoc, 0, len(s.tagM))
+	for _, doc := range s.tagM {
+		tagdocs = append(tagdocs, *doc)
+	}
+	return s.writeJSON("tag.json", tagdocs)
+}
+
+func (s *FileStore) ListTarget() (error, *[]TargetDoc) {
+	s.RLock()
+	defer s.RUnlock()
+
+	targetdocs := make([]TargetDoc, 0, len(s.targetM))
+	for _, doc := range s.targetM {
+		targetdocs = append(targetdocs, *doc)
+	}
+	return nil, &targetdocs
+}
+
+func (s *FileStore) AddTarget(ObuMAC string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.targetM[ObuMAC] = &TargetDoc{
+		ObuMAC: ObuMAC}
+	return s.writeTargets()
+}
+
+func (s *FileStore) DeleteTarget(ObuMAC string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.targetM, ObuMAC)
+	return s.writeTargets()
+}
+
+func (s *FileStore) writeTargets() error {
+	targetdocs := make([]TargetDoc, 0, len(s.targetM))
+	for _, doc := range s.targetM {
+		targetdocs = append(targetdocs, *doc)
+	}
+	return s.writeJSON("target.json", targetdocs)
+}
+
+func (s *FileStore) TargetIsLocated(ObuMAC string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	_, ok := s.targetM[ObuMAC]
+	return ok
+}
+
+func (s *FileStore) ListRsu() (error, *[]RsuDoc) {
+	s.RLock()
+	defer s.RUnlock()
+
+	rsudocs := make([]RsuDoc, 0, len(s.rsuM))
+	for _, doc := range s.rsuM {
+		rsudocs = append(rsudocs, *doc)
+	}
+	return nil, &rsudocs
+}
+
+func (s *FileStore) UpdateRsu(doc *RsuDoc) error {
+	s.Lock()
+	defer s.Unlock()
+
+	d := *doc
+	s.rsuM[doc.ID] = &d
+	return s.writeRsus()
+}
+
+func (s *FileStore) DeleteRsu(ID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.rsuM, ID)
+	return s.writeRsus()
+}
+
+func (s *FileStore) writeRsus() error {
+	rsudocs := make([]RsuDoc, 0, len(s.rsuM))
+	for _, doc := range s.rsuM {
+		rsudocs = append(rsudocs, *doc)
+	}
+	return s.writeJSON("rsu.json", rsudocs)
+}
+
+func (s *FileStore) Close() {
+	close(s.exitChan)
+	s.wg.Wait()
+
+	s.Lock()
+	defer s.Unlock()
+	if s.eventFile != nil {
+		s.eventFile.Close()
+		s.eventFile = nil
+	}
+}
+
+func (s *FileStore) readJSON(name string, v interface{}) error {
+	buf, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// writeJSON replaces the named file atomically
+func (s *FileStore) writeJSON(name string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, name)
+	err = ioutil.WriteFile(path+".tmp", buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
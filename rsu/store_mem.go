@@ -0,0 +1,197 @@
+package rsu
+
+import (
+	"sync"
+)
+
+// MemStore is a Store kept in memory, for tests that should not need
+// a MongoDB server or a data directory. SetError makes every read and
+// write fail, as during a store outage.
+type MemStore struct {
+	sync.RWMutex
+	events  []EventDoc
+	tagM    map[uint32]*TagDoc
+	targetM map[string]*TargetDoc
+	rsuM    map[string]*RsuDoc
+	err     error
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		tagM:    make(map[uint32]*TagDoc),
+		targetM: make(map[string]*TargetDoc),
+		rsuM:    make(map[string]*RsuDoc),
+	}
+}
+
+// SetError makes reads and writes fail with err until it is called
+// with nil
+func (s *MemStore) SetError(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.err = err
+}
+
+// Events returns every stored event, oldest first
+func (s *MemStore) Events() []EventDoc {
+	s.RLock()
+	defer s.RUnlock()
+	return append([]EventDoc(nil), s.events...)
+}
+
+func (s *MemStore) WriteObuEvent(event *ObuEvent) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	var tags []string
+	tagDoc, ok := s.tagM[staRoadKey(event.Station, event.Roadway)]
+	if ok {
+		tags = tagDoc.Tags
+	}
+	s.events = append(s.events, *newEventDoc(event, tags))
+	return nil
+}
+
+func (s *MemStore) FindObuEvent(from, to, station, roadway, vehicle, tags string, events *[]EventDoc) error {
+	q, err := parseEventQuery(from, to, station, roadway, vehicle, tags)
+	if err != nil {
+		return err
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	for i := range s.events {
+		if len(*events) >= eventQueryLimit {
+			break
+		}
+		if q.match(&s.events[i]) {
+			*events = append(*events, s.events[i])
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) ListTag() (error, *[]TagDoc) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.err != nil {
+		return s.err, nil
+	}
+	tagdocs := make([]TagDoc, 0, len(s.tagM))
+	for _, doc := range s.tagM {
+		tagdocs = append(tagdocs, *doc)
+	}
+	return nil, &tagdocs
+}
+
+func (s *MemStore) UpdateTag(station uint16, roadway uint8, tags []string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.tagM[staRoadKey(station, roadway)] = &TagDoc{
+		Station: station,
+		Roadway: roadway,
+		Tags:    tags}
+	return nil
+}
+
+func (s *MemStore) ListTarget() (error, *[]TargetDoc) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.err != nil {
+		return s.err, nil
+	}
+	targetdocs := make([]TargetDoc, 0, len(s.targetM))
+	for _, doc := range s.targetM {
+		targetdocs = append(targetdocs, *doc)
+	}
+	return nil, &targetdocs
+}
+
+func (s *MemStore) AddTarget(ObuMAC string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.targetM[ObuMAC] = &TargetDoc{
+		ObuMAC: ObuMAC}
+	return nil
+}
+
+func (s *MemStore) DeleteTarget(ObuMAC string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	delete(s.targetM, ObuMAC)
+	return nil
+}
+
+func (s *MemStore) TargetIsLocated(ObuMAC string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	_, ok := s.targetM[ObuMAC]
+	return ok
+}
+
+func (s *MemStore) ListRsu() (error, *[]RsuDoc) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.err != nil {
+		return s.err, nil
+	}
+	rsudocs := make([]RsuDoc, 0, len(s.rsuM))
+	for _, doc := range s.rsuM {
+		rsudocs = append(rsudocs, *doc)
+	}
+	return nil, &rsudocs
+}
+
+func (s *MemStore) UpdateRsu(doc *RsuDoc) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	d := *doc
+	s.rsuM[doc.ID] = &d
+	return nil
+}
+
+func (s *MemStore) DeleteRsu(ID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	delete(s.rsuM, ID)
+	return nil
+}
+
+// Reload is a no-op; nothing outside the store can change it
+func (s *MemStore) Reload() error {
+	return nil
+}
+
+func (s *MemStore) Close() {
+}
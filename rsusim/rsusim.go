@@ -0,0 +1,430 @@
+// Package rsusim simulates roadside units for testing agentd without
+// hardware. A simulated RSU dials agentd, answers its requests from
+// settings it keeps like a real RSU would, reports synthetic OBU events
+// and can be told to misbehave.
+package rsusim
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/aiyi/agent/agent"
+	"github.com/aiyi/agent/rsu"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrClosed = errors.New("simulated RSU closed")
+
+// Config sets up a simulated RSU
+type Config struct {
+	// settings reported to agentd until it changes them
+	Station      uint16
+	Roadway      uint8
+	Channel      uint8
+	TxPower      uint8
+	RevSensitive uint8
+	AntennaOpen  bool
+
+	// OBU events reported per second, 0 for none. Events are only
+	// reported while the antenna is open.
+	EventRate float64
+	// fraction of events given bytes that must be escaped on the wire
+	EscapeRate float64
+
+	// faults
+	Delay           time.Duration // added before every response
+	DropRate        float64       // fraction of requests left unanswered
+	BadBCCRate      float64       // fraction of frames sent with a corrupt checksum
+	DisconnectAfter time.Duration // hang up after this long, 0 never
+
+	// Seed seeds the random source, 0 for the current time
+	Seed int64
+}
+
+// NewConfig returns a Config for an RSU at station and roadway that
+// behaves and reports an event every second
+func NewConfig(station uint16, roadway uint8) Config {
+	return Config{
+		Station:      station,
+		Roadway:      roadway,
+		Channel:      1,
+		TxPower:      10,
+		RevSensitive: 5,
+		AntennaOpen:  true,
+		EventRate:    1,
+		EscapeRate:   0.1,
+	}
+}
+
+// State are the settings an RSU reports
+type State struct {
+	Station      uint16
+	Roadway      uint8
+	Channel      uint8
+	TxPower      uint8
+	RevSensitive uint8
+	AntennaOpen  bool
+}
+
+// Stats counts the traffic of a simulated RSU
+type Stats struct {
+	Requests  uint64
+	Responses uint64
+	Dropped   uint64
+	Events    uint64
+	BadBCCs   uint64
+	BadFrames uint64
+}
+
+// RSU is a simulated RSU connected to agentd
+type RSU struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	stats Stats
+
+	cfg    Config
+	conn   net.Conn
+	logger *agent.Logger
+
+	stateMtx sync.Mutex
+	state    State
+
+	randMtx sync.Mutex
+	rand    *rand.Rand
+
+	writeMtx sync.Mutex
+	seq      uint8
+
+	closeOnce sync.Once
+	exitChan  chan int
+	errMtx    sync.Mutex
+	err       error
+	wg        sync.WaitGroup
+}
+
+// Dial connects a simulated RSU to the agentd listening on addr
+func Dial(addr string, cfg Config) (*RSU, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	r := &RSU{
+		cfg:    cfg,
+		conn:   conn,
+		logger: agent.DefaultLogger().With("rsu", rsu.DeviceID(cfg.Station, cfg.Roadway)),
+		state: State{
+			Station:      cfg.Station,
+			Roadway:      cfg.Roadway,
+			Channel:      cfg.Channel,
+			TxPower:      cfg.TxPower,
+			RevSensitive: cfg.RevSensitive,
+			AntennaOpen:  cfg.AntennaOpen,
+		},
+		rand:     rand.New(rand.NewSource(seed)),
+		exitChan: make(chan int),
+	}
+
+	r.wg.Add(2)
+	go r.readLoop()
+	go r.eventLoop()
+	return r, nil
+}
+
+// State returns the current settings
+func (r *RSU) State() State {
+	r.stateMtx.Lock()
+	defer r.stateMtx.Unlock()
+	return r.state
+}
+
+// Stats returns a snapshot of the counters
+func (r *RSU) Stats() Stats {
+	return Stats{
+		Requests:  atomic.LoadUint64(&r.stats.Requests),
+		Responses: atomic.LoadUint64(&r.stats.Responses),
+		Dropped:   atomic.LoadUint64(&r.stats.Dropped),
+		Events:    atomic.LoadUint64(&r.stats.Events),
+		BadBCCs:   atomic.LoadUint64(&r.stats.BadBCCs),
+		BadFrames: atomic.LoadUint64(&r.stats.BadFrames),
+	}
+}
+
+// Close hangs up
+func (r *RSU) Close() error {
+	r.stop(ErrClosed)
+	r.wg.Wait()
+	return nil
+}
+
+// Done is closed once the RSU has hung up, see Err for why
+func (r *RSU) Done() <-chan int {
+	return r.exitChan
+}
+
+// Err returns why the RSU hung up, or nil while it is connected
+func (r *RSU) Err() error {
+	r.errMtx.Lock()
+	defer r.errMtx.Unlock()
+	return r.err
+}
+
+func (r *RSU) stop(err error) {
+	r.closeOnce.Do(func() {
+		r.errMtx.Lock()
+		r.err = err
+		r.errMtx.Unlock()
+		close(r.exitChan)
+		r.conn.Close()
+	})
+}
+
+func (r *RSU) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	r.randMtx.Lock()
+	defer r.randMtx.Unlock()
+	return r.rand.Float64() < p
+}
+
+func (r *RSU) readLoop() {
+	if r.cfg.DisconnectAfter > 0 {
+		t := time.AfterFunc(r.cfg.DisconnectAfter, func() {
+			r.logger.Info("disconnecting")
+			r.stop(fmt.Errorf("disconnected after %s", r.cfg.DisconnectAfter))
+		})
+		defer t.Stop()
+	}
+
+	br := bufio.NewReader(r.conn)
+	for {
+		body, err := rsu.ReadFrame(br)
+		if err == rsu.ChecksumError || err == rsu.InvalidPacketError {
+			atomic.AddUint64(&r.stats.BadFrames, 1)
+			r.logger.Warn("dropping corrupt frame", "err", err)
+			continue
+		}
+		if err != nil {
+			r.stop(err)
+			goto exit
+		}
+
+		atomic.AddUint64(&r.stats.Requests, 1)
+		seq := body[0]
+		msgType := uint16(body[1])<<8 | uint16(body[2])
+		resp, data, ok := r.handle(msgType, body[3:])
+		if !ok {
+			r.logger.Warn("unknown request", "msgType", fmt.Sprintf("0x%04X", msgType))
+			continue
+		}
+		if r.chance(r.cfg.DropRate) {
+			atomic.AddUint64(&r.stats.Dropped, 1)
+			r.logger.Debug("dropping response", "msgType", fmt.Sprintf("0x%04X", resp))
+			continue
+		}
+		if r.cfg.Delay > 0 {
+			select {
+			case <-time.After(r.cfg.Delay):
+			case <-r.exitChan:
+				goto exit
+			}
+		}
+
+		err = r.send(seq&0x07, resp, data)
+		if err != nil {
+			r.stop(err)
+			goto exit
+		}
+		atomic.AddUint64(&r.stats.Responses, 1)
+	}
+
+exit:
+	r.wg.Done()
+}
+
+// handle applies a request to the settings and returns the response
+// type and data
+func (r *RSU) handle(msgType uint16, data []byte) (uint16, []byte, bool) {
+	r.stateMtx.Lock()
+	defer r.stateMtx.Unlock()
+
+	const ok = 0
+	const failed = 1
+
+	switch msgType {
+	case rsu.HeartbeatRequest:
+		return rsu.HeartbeatResponse, []byte{ok}, true
+	case rsu.OpenAntRequest:
+		r.state.AntennaOpen = true
+		return rsu.OpenAntResponse, []byte{ok}, true
+	case rsu.CloseAntRequest:
+		r.state.AntennaOpen = false
+		return rsu.CloseAntResponse, []byte{ok}, true
+	case rsu.GetStaRoadRequest:
+		return rsu.GetStaRoadResponse, []byte{byte(r.state.Station >> 8), byte(r.state.Station), r.state.Roadway}, true
+	case rsu.GetChannelRequest:
+		return rsu.GetChannelResponse, []byte{r.state.Channel}, true
+	case rsu.GetTxPowerRequest:
+		return rsu.GetTxPowerResponse, []byte{r.state.TxPower}, true
+	case rsu.GetRevSensitiveRequest:
+		return rsu.GetRevSensitiveResponse, []byte{r.state.RevSensitive}, true
+	case rsu.SetStaRoadRequest:
+		if len(data) != 3 {
+			return rsu.SetStaRoadResponse, []byte{failed}, true
+		}
+		r.state.Station = uint16(data[0])<<8 | uint16(data[1])
+		r.state.Roadway = data[2]
+		return rsu.SetStaRoadResponse, []byte{ok}, true
+	case rsu.SetTxPowerRequest:
+		if len(data) != 1 {
+			return rsu.SetTxPowerResponse, []byte{failed}, true
+		}
+		r.state.TxPower = data[0]
+		return rsu.SetTxPowerResponse, []byte{ok}, true
+	case rsu.SetRevSensitiveRequest:
+		if len(data) != 1 {
+			return rsu.SetRevSensitiveResponse, []byte{failed}, true
+		}
+		r.state.RevSensitive = data[0]
+		return rsu.SetRevSensitiveResponse, []byte{ok}, true
+	}
+	return 0, nil, false
+}
+
+// send writes a frame, corrupting its checksum at BadBCCRate. The
+// sequence byte carries the 0x80 flag, as from a real RSU.
+func (r *RSU) send(seq uint8, msgType uint16, data []byte) error {
+	body := append([]byte{0x80 | seq, byte(msgType >> 8), byte(msgType)}, data...)
+
+	var frame []byte
+	if r.chance(r.cfg.BadBCCRate) {
+		atomic.AddUint64(&r.stats.BadBCCs, 1)
+		frame = []byte{0xFF, 0xFF}
+		frame = rsu.Escape(frame, body)
+		frame = rsu.Escape(frame, []byte{^rsu.GetBCC(body)})
+		frame = append(frame, 0xFF)
+	} else {
+		frame = rsu.EncodeFrame(body)
+	}
+
+	r.writeMtx.Lock()
+	defer r.writeMtx.Unlock()
+	_, err := r.conn.Write(frame)
+	return err
+}
+
+// SendObuEvent reports e to agentd
+func (r *RSU) SendObuEvent(e *rsu.ObuEvent) error {
+	data, err := rsu.EncodeObuEvent(e)
+	if err != nil {
+		return err
+	}
+
+	r.writeMtx.Lock()
+	seq := r.seq
+	r.seq = (r.seq + 1) & 0x07
+	r.writeMtx.Unlock()
+
+	err = r.send(seq, rsu.ObuEventReport, data)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&r.stats.Events, 1)
+	return nil
+}
+
+func (r *RSU) eventLoop() {
+	if r.cfg.EventRate <= 0 {
+		goto exit
+	}
+
+	for {
+		r.randMtx.Lock()
+		wait := time.Duration(r.rand.ExpFloat64() / r.cfg.EventRate * float64(time.Second))
+		r.randMtx.Unlock()
+
+		select {
+		case <-time.After(wait):
+		case <-r.exitChan:
+			goto exit
+		}
+
+		state := r.State()
+		if !state.AntennaOpen {
+			continue
+		}
+		r.randMtx.Lock()
+		e := RandomObuEvent(r.rand, state.Station, state.Roadway, r.cfg.EscapeRate)
+		r.randMtx.Unlock()
+
+		err := r.SendObuEvent(e)
+		if err != nil {
+			r.stop(err)
+			goto exit
+		}
+	}
+
+exit:
+	r.wg.Done()
+}
+
+var (
+	provinces = []string{"京", "津", "沪", "渝", "冀", "豫", "云", "辽", "黑", "湘", "皖", "鲁", "苏", "浙", "赣", "鄂", "桂", "甘", "晋", "陕", "吉", "闽", "贵", "粤", "川", "青", "琼", "宁"}
+	// plate letters leave out I and O
+	plateLetters = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+	plateChars   = "ABCDEFGHJKLMNPQRSTUVWXYZ0123456789"
+)
+
+// RandomPlate returns a vehicle number such as 京A12345
+func RandomPlate(rnd *rand.Rand) string {
+	b := []byte{plateLetters[rnd.Intn(len(plateLetters))]}
+	for i := 0; i < 5; i++ {
+		b = append(b, plateChars[rnd.Intn(len(plateChars))])
+	}
+	return provinces[rnd.Intn(len(provinces))] + string(b)
+}
+
+// randomHex returns n random bytes as hex, making one of them 0xFE or
+// 0xFF if escape is set
+func randomHex(rnd *rand.Rand, n int, escape bool) string {
+	b := make([]byte, n)
+	rnd.Read(b)
+	if escape {
+		b[rnd.Intn(n)] = 0xFE + byte(rnd.Intn(2))
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// RandomObuEvent returns an event for a passing vehicle seen by the RSU
+// at station and roadway. At escapeRate the MAC, contract number or
+// PSAM ID contains a byte that must be escaped on the wire.
+func RandomObuEvent(rnd *rand.Rand, station uint16, roadway uint8, escapeRate float64) *rsu.ObuEvent {
+	escape := rnd.Float64() < escapeRate
+	field := rnd.Intn(3)
+
+	mac := randomHex(rnd, 4, escape && field == 0)
+	return &rsu.ObuEvent{
+		SchemaVersion:      rsu.ObuEventSchemaVersion,
+		Timestamp:          time.Now().Unix(),
+		Station:            station,
+		Roadway:            roadway,
+		VehicleNumber:      RandomPlate(rnd),
+		ObuMAC:             fmt.Sprintf("%s:%s:%s:%s", mac[0:2], mac[2:4], mac[4:6], mac[6:8]),
+		VehicleType:        uint8(1 + rnd.Intn(4)),
+		UserType:           uint8(rnd.Intn(2)),
+		RsuTransactionMode: uint8(rnd.Intn(2)),
+		ContractSN:         randomHex(rnd, 8, escape && field == 1),
+		ObuStatus:          uint16(rnd.Intn(4)),
+		Battery:            uint8(60 + rnd.Intn(41)),
+		PSAMID:             randomHex(rnd, 6, escape && field == 2),
+		TrSN:               rnd.Uint32(),
+	}
+}
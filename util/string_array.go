@@ -0,0 +1,22 @@
+package util
+
+import (
+	"strings"
+)
+
+// StringArray is a flag.Value that collects every occurrence of a
+// repeated flag
+type StringArray []string
+
+func (a *StringArray) Set(s string) error {
+	*a = append(*a, s)
+	return nil
+}
+
+func (a *StringArray) Get() interface{} {
+	return []string(*a)
+}
+
+func (a *StringArray) String() string {
+	return strings.Join(*a, ",")
+}